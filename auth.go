@@ -19,14 +19,19 @@
 package charon
 
 import (
-	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"log"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AlexMax/charon/srp"
@@ -36,95 +41,351 @@ import (
 // authentication server.
 type AuthApp struct {
 	config        *Config
-	database      *Database
-	sessions      sessions
-	sessionsMutex sync.Mutex
+	database      Store
+	policy        *Policy
+	secret        []byte
+	sourceLimiter *rateLimiter
+	userLimiter   *rateLimiter
+	sessions      SessionStore
+	buffers       sync.Pool
+	stats         AuthStats
+	draining      int32
 }
 
-type sessions map[uint32]*srp.ServerSession
+// AuthStats contains counters describing the load on the auth server.
+type AuthStats struct {
+	Received uint64 // Packets read from the network
+	Dropped  uint64 // Packets dropped because the queue was full
+}
+
+// Size of the buffer that packets are read into.
+const packetBufferSize = 1024
+
+// Shortest auth secret that is accepted, in bytes.
+const minSecretLength = 16
+
+// Auth secret in the example configuration, which must be changed.
+const exampleSecret = "change me to something long and random"
 
 type request struct {
-	address *net.UDPAddr
+	address net.Addr
 	message []byte
 }
 
+// queuedRequest is a request waiting for a worker, along with the transport
+// to respond on and the buffer that must be returned to the pool once the
+// request is handled, if any.
+type queuedRequest struct {
+	transport transport
+	req       request
+	buffer    *[]byte
+}
+
 type response struct {
-	address *net.UDPAddr
+	address net.Addr
 	message []byte
 }
 
-type routeFunc func(*request) (response, error)
+type routeFunc func(context.Context, *request) (response, error)
+
+// NewAuthApp creates a new instance of the auth server app.  The database
+// may be shared with other apps, and is not closed by the auth server.
+func NewAuthApp(config *Config, database Store) (authApp *AuthApp, err error) {
+	err = config.Validate()
+	if err != nil {
+		return
+	}
 
-// NewAuthApp creates a new instance of the auth server app.
-func NewAuthApp(config *Config) (authApp *AuthApp, err error) {
 	authApp = new(AuthApp)
 
 	// Attach configuration
 	authApp.config = config
 
-	// Initialize database connection
-	database, err := NewDatabase(config)
-	if err != nil {
+	// Attach database
+	authApp.database = database
+
+	// Initialize authentication policy
+	authApp.policy = NewPolicy(config)
+
+	// Initialize rate limiters
+	authApp.sourceLimiter = newRateLimiter(config.RateLimit.SourceRate, config.RateLimit.SourceBurst)
+	authApp.userLimiter = newRateLimiter(config.RateLimit.UserRate, config.RateLimit.UserBurst)
+
+	// Initialize server secret, used to answer for unknown users and to
+	// encrypt sessions kept in the database.
+	if config.Auth.Secret == exampleSecret {
+		err = errors.New("auth secret must be changed from the example")
+		return
+	} else if len(config.Auth.Secret) >= minSecretLength {
+		authApp.secret = []byte(config.Auth.Secret)
+	} else if config.Auth.Secret != "" {
+		err = fmt.Errorf("auth secret must be at least %d bytes long", minSecretLength)
 		return
+	} else if config.Auth.SessionStore == "database" {
+		// Auth servers sharing sessions must encrypt them the same way.
+		err = errors.New("auth secret must be configured to keep sessions in the database")
+		return
+	} else {
+		log.Print("[WARNING] No auth secret configured, unknown users will get different salts after a restart")
+		authApp.secret = make([]byte, 32)
+		_, err = rand.Read(authApp.secret)
+		if err != nil {
+			return
+		}
 	}
-	authApp.database = database
 
 	// Initialize session store
-	authApp.sessions = make(sessions)
+	authApp.sessions, err = NewSessionStore(config, database, authApp.secret)
+	if err != nil {
+		return
+	}
+
+	// Initialize packet buffers
+	authApp.buffers.New = func() interface{} {
+		buffer := make([]byte, packetBufferSize)
+		return &buffer
+	}
 
 	return
 }
 
-// ListenAndServe starts the auth server app.
-func (authApp *AuthApp) ListenAndServe(addr string) (err error) {
-	listenaddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return
+// ListenAndServe has the auth server listen for UDP packets on one or more
+// addresses.  See Serve for how the server is stopped.
+func (authApp *AuthApp) ListenAndServe(ctx context.Context, addrs ...string) error {
+	return authApp.ListenAndServeWithTCP(ctx, addrs, nil)
+}
+
+// ListenAndServeWithTCP has the auth server listen for UDP packets on one set
+// of addresses and TCP connections on another.  See Serve for how the server
+// is stopped.
+func (authApp *AuthApp) ListenAndServeWithTCP(ctx context.Context, udpAddrs []string, tcpAddrs []string) (err error) {
+	conns := make([]*net.UDPConn, 0, len(udpAddrs))
+	listeners := make([]net.Listener, 0, len(tcpAddrs))
+	defer func() {
+		// Only clean up if we never got as far as serving.
+		if err != nil {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			for _, listener := range listeners {
+				listener.Close()
+			}
+		}
+	}()
+
+	for _, addr := range udpAddrs {
+		listenaddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return err
+		}
+
+		conn, err := net.ListenUDP("udp", listenaddr)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		log.Printf("[DEBUG] Auth server listening on %s/udp", conn.LocalAddr())
+	}
+
+	for _, addr := range tcpAddrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+		log.Printf("[DEBUG] Auth server listening on %s/tcp", listener.Addr())
 	}
 
-	conn, err := net.ListenUDP("udp", listenaddr)
+	return authApp.ServeWithTCP(ctx, conns, listeners)
+}
+
+// Serve handles incoming requests on one or more existing UDP connections
+// using a fixed pool of workers.  Requests that arrive while the queue is
+// full are dropped.
+//
+// Once the context is cancelled, new negotiations are turned away while
+// sessions that are already in progress are given until the configured
+// shutdown timeout to finish.  The connections are then closed and Serve
+// returns nil.  If a connection is closed by anybody else, the
+// other connections are closed and Serve returns the error from reading the
+// closed connection.
+func (authApp *AuthApp) Serve(ctx context.Context, conns ...*net.UDPConn) error {
+	return authApp.ServeWithTCP(ctx, conns, nil)
+}
+
+// ServeWithTCP is like Serve, but also accepts TCP connections on existing
+// listeners.  Requests sent over TCP are handled by the same workers as UDP
+// requests.
+func (authApp *AuthApp) ServeWithTCP(ctx context.Context, conns []*net.UDPConn, listeners []net.Listener) (err error) {
+	if len(conns) == 0 && len(listeners) == 0 {
+		return errors.New("no connections to serve")
+	}
+
+	workerCount := authApp.config.Auth.Workers
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	queue := make(chan queuedRequest, authApp.config.Auth.QueueSize)
+	var workers sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for queued := range queue {
+				authApp.requestHandler(queued.transport, &queued.req)
+				if queued.buffer != nil {
+					authApp.buffers.Put(queued.buffer)
+				}
+			}
+		}()
+	}
+
+	readers := make(chan error, len(conns)+len(listeners))
+	for _, conn := range conns {
+		go func(conn *net.UDPConn) {
+			readers <- authApp.readRequests(conn, queue)
+		}(conn)
+	}
+	clients := newTCPClients(authApp.config.Auth.MaxTCPConns)
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			readers <- authApp.acceptTCP(listener, queue, clients)
+		}(listener)
+	}
+	running := len(conns) + len(listeners)
+
+	// Run until the context is cancelled or a connection is lost.
+	select {
+	case <-ctx.Done():
+		err = authApp.drain(readers)
+		if err != nil {
+			running--
+		}
+	case err = <-readers:
+		running--
+	}
+
+	// Stop reading requests before stopping the workers.
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	for ; running > 0; running-- {
+		<-readers
+	}
+	clients.closeAll()
+	close(queue)
+	workers.Wait()
+
 	if err != nil {
 		return
 	}
+	return authApp.sessions.Close()
+}
 
+// readRequests reads requests from a connection and queues them for the
+// workers until the connection is closed.
+func (authApp *AuthApp) readRequests(conn *net.UDPConn, queue chan<- queuedRequest) error {
 	for {
-		message := make([]byte, 1024)
+		buffer := authApp.buffers.Get().(*[]byte)
 
-		msglen, msgaddr, msgerr := conn.ReadFromUDP(message)
+		msglen, msgaddr, msgerr := conn.ReadFromUDP(*buffer)
 		if msgerr != nil {
-			log.Printf("[ERROR] %s", err.Error())
+			authApp.buffers.Put(buffer)
+			if errors.Is(msgerr, net.ErrClosed) {
+				return msgerr
+			}
+			log.Printf("[ERROR] %s", msgerr.Error())
 			continue
 		}
+		atomic.AddUint64(&authApp.stats.Received, 1)
+
+		queued := queuedRequest{udpTransport{conn}, request{msgaddr, (*buffer)[:msglen]}, buffer}
+		select {
+		case queue <- queued:
+		default:
+			atomic.AddUint64(&authApp.stats.Dropped, 1)
+			authApp.buffers.Put(buffer)
+		}
+	}
+}
+
+// drain stops new negotiations and waits for existing sessions to finish, or
+// for the shutdown timeout to pass.  If a connection is lost in the meantime,
+// its error is returned.
+func (authApp *AuthApp) drain(readers <-chan error) (err error) {
+	atomic.StoreInt32(&authApp.draining, 1)
+
+	timeout := time.After(authApp.config.Auth.ShutdownTimeout)
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		remaining, err := authApp.sessions.Pending(context.Background())
+		if err != nil {
+			log.Printf("[ERROR] %s", err.Error())
+			return nil
+		}
+		if remaining == 0 {
+			return nil
+		}
 
-		req := request{msgaddr, message[:msglen]}
-		go authApp.requestHandler(conn, &req)
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			log.Printf("[WARNING] Shutting down with %d sessions in progress", remaining)
+			return nil
+		case err = <-readers:
+			return err
+		}
 	}
 }
 
-func (authApp *AuthApp) requestHandler(conn *net.UDPConn, req *request) {
+// Stats returns a snapshot of the auth server's counters.
+func (authApp *AuthApp) Stats() (stats AuthStats) {
+	stats.Received = atomic.LoadUint64(&authApp.stats.Received)
+	stats.Dropped = atomic.LoadUint64(&authApp.stats.Dropped)
+	return
+}
+
+func (authApp *AuthApp) requestHandler(transport transport, req *request) {
+	// A reply that takes longer than a session lives is of no use.
+	ctx, cancel := context.WithTimeout(context.Background(), authApp.config.Auth.SessionTTL)
+	defer cancel()
+
 	// Select callback function to route to.
-	route, err := authApp.router(req)
+	route, err := authApp.router(ctx, req)
 	if err != nil {
 		log.Printf("[DEBUG] %s", err.Error())
 		return
 	}
 
 	// Route message to callback function.
-	res, err := route(req)
+	res, err := route(ctx, req)
 	if err != nil {
 		log.Printf("[DEBUG] %s", err.Error())
 		return
 	}
 
 	// Respond to sender.
-	_, err = conn.WriteToUDP(res.message, res.address)
+	err = transport.respond(res)
 	if err != nil {
 		log.Printf("[DEBUG] %s", err.Error())
 		return
 	}
 }
 
-func (authApp *AuthApp) router(req *request) (route routeFunc, err error) {
+func (authApp *AuthApp) router(ctx context.Context, req *request) (route routeFunc, err error) {
+	// Only registered game servers may make requests.
+	if authApp.config.Auth.ServerAuth {
+		err = authApp.verifyServer(ctx, req)
+		if err != nil {
+			return
+		}
+	}
+
 	if len(req.message) < 4 {
 		err = errors.New("Message is too small")
 		return
@@ -146,57 +407,151 @@ func (authApp *AuthApp) router(req *request) (route routeFunc, err error) {
 	return
 }
 
+// Verify that a request was signed by a registered game server, and strip
+// the signature from the request.
+func (authApp *AuthApp) verifyServer(ctx context.Context, req *request) (err error) {
+	message, serverID, _, err := splitSignature(req.message)
+	if err != nil {
+		return
+	}
+
+	server, err := authApp.database.FindServer(ctx, uint(serverID))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("server %d is not registered", serverID)
+	} else if err != nil {
+		return
+	}
+	if !server.Active {
+		return fmt.Errorf("server %d has been revoked", serverID)
+	}
+	if !server.Allows(addressIP(req.address)) {
+		return fmt.Errorf("server %d is not allowed from %s", serverID, req.address)
+	}
+	if !verifySignature(req.message, server.Secret) {
+		return fmt.Errorf("server %d sent an invalid signature", serverID)
+	}
+
+	req.message = message
+	return
+}
+
 // Handle initial negotiation
-func (authApp *AuthApp) handleNegotiate(req *request) (res response, err error) {
+func (authApp *AuthApp) handleNegotiate(ctx context.Context, req *request) (res response, err error) {
 	var packet ServerNegotiate
 	err = packet.UnmarshalBinary(req.message)
 	if err != nil {
 		return
 	}
 
+	// Don't start new sessions while shutting down.
+	if atomic.LoadInt32(&authApp.draining) != 0 {
+		return authApp.userError(req, packet.ClientSession, UserErrorTryLater)
+	}
+
+	// Ensure that the game server isn't flooding us.
+	if !authApp.sourceLimiter.Allow(addressIP(req.address).String()) {
+		return authApp.userError(req, packet.ClientSession, UserErrorTryLater)
+	}
+
 	// Ensure that the user exists.
-	user, err := authApp.database.FindUser(packet.username)
-	if err != nil {
-		return
+	// If they don't, pretend that they do so nobody can tell the difference.
+	// Users are only found by name, as the reply contains the name.
+	user, err := authApp.database.FindUserByName(ctx, packet.Username)
+	decoy := false
+	if err == sql.ErrNoRows {
+		user = authApp.decoyUser(packet.Username)
+		decoy = true
+	} else if err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+		return authApp.userError(req, packet.ClientSession, UserErrorTryLater)
 	}
 
-	// Create a new random session ID
-	sessionBytes := make([]byte, 4)
-	_, err = rand.Read(sessionBytes)
-	if err != nil {
-		return
+	// Ensure that the user isn't being flooded, however they are named.
+	userKey := "name:" + user.Username
+	if !decoy {
+		userKey = fmt.Sprintf("id:%d", user.ID)
 	}
-	var sessionID uint32
-	sessionBuffer := bytes.NewBuffer(sessionBytes)
-	err = binary.Read(sessionBuffer, binary.LittleEndian, &sessionID)
-	if err != nil {
-		return
+	if !authApp.userLimiter.Allow(userKey) {
+		return authApp.userError(req, packet.ClientSession, UserErrorTryLater)
+	}
+
+	// A verifier in a group we no longer trust can't be used to log in, but
+	// only somebody who knows the password may find out, so the session
+	// carries on as usual.  Groups that aren't loaded at all get a decoy.
+	unsafe := false
+	if !decoy && checkSRPGroup(user.SRPGroup, authApp.config.SRP.MinGroupSize) != nil {
+		unsafe = true
+		if _, err := srp.GetGroup(user.SRPGroup); err != nil {
+			user = authApp.decoyUser(user.Username)
+			decoy = true
+		}
+	}
+
+	// Speak the highest protocol version both sides understand.
+	version := packet.Version
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	// Older game servers can't be told which group, hash and key derivation
+	// to use, so only users with the legacy parameters can log in through
+	// them.  Everybody else gets a legacy decoy that keeps their salt, so
+	// that unknown users and users with newer parameters look the same as
+	// users with a wrong password.
+	if version < 3 && !isLegacySRP(user.SRPGroup, user.SRPHash, user.KDF) {
+		salt := user.Salt
+		user = authApp.decoyUser(user.Username)
+		user.SRPGroup = LegacySRPGroup
+		user.SRPHash = LegacySRPHash
+		user.KDF = LegacyKDF
+		user.Salt = salt
+		decoy = true
 	}
 
 	// Create new SRP session
-	srpo, err := srp.NewSRP("rfc5054.2048", sha256.New, nil)
+	srpo, err := NewSRP(user.SRPGroup, user.SRPHash, user.KDF)
 	if err != nil {
 		return
 	}
-	authApp.sessionsMutex.Lock()
-	authApp.sessions[sessionID] = srpo.NewServerSession(
-		[]byte(user.Username), user.Salt, user.Verifier)
-	authApp.sessionsMutex.Unlock()
-	go func() {
-		// Time out session after a few seconds
-		time.Sleep(time.Second * 5)
-		authApp.sessionsMutex.Lock()
-		delete(authApp.sessions, sessionID)
-		authApp.sessionsMutex.Unlock()
-	}()
+
+	session := &AuthSession{
+		Address: req.address,
+		SRP: srpo.NewServerSession(
+			[]byte(user.Username), user.Salt, user.Verifier),
+		User:    user,
+		Version: version,
+		Decoy:   decoy,
+		Unsafe:  unsafe,
+	}
+
+	// Store the session under a new random session ID
+	for {
+		session.ID, err = randomSessionID()
+		if err != nil {
+			return
+		}
+		err = authApp.sessions.Add(ctx, session)
+		if err != ErrSessionExists {
+			break
+		}
+	}
+	if err == ErrSessionStoreFull {
+		log.Printf("[WARNING] %s", err.Error())
+		return authApp.userError(req, packet.ClientSession, UserErrorTryLater)
+	} else if err != nil {
+		return
+	}
 
 	// Assemble response
 	var resPacket AuthNegotiate
-	resPacket.clientSession = packet.clientSession
-	resPacket.session = sessionID
-	resPacket.salt = user.Salt
-	resPacket.username = user.Username
-	resPacket.version = 2
+	resPacket.ClientSession = packet.ClientSession
+	resPacket.Session = session.ID
+	resPacket.Salt = user.Salt
+	resPacket.Username = user.Username
+	resPacket.Group = user.SRPGroup
+	resPacket.Hash = user.SRPHash
+	resPacket.KDF = user.KDF
+	resPacket.Version = version
 	message, err := resPacket.MarshalBinary()
 	if err != nil {
 		return
@@ -208,41 +563,93 @@ func (authApp *AuthApp) handleNegotiate(req *request) (res response, err error)
 	return
 }
 
+// Create a user that does not exist.  Its salt is derived from the server
+// secret so that repeated negotiations for the same username look identical
+// to negotiations for a real user.
+func (authApp *AuthApp) decoyUser(username string) (user *User) {
+	username = strings.ToLower(username)
+
+	user = new(User)
+	user.Username = username
+	user.SRPGroup = authApp.config.SRP.Group
+	user.SRPHash = authApp.config.SRP.Hash
+	user.KDF = authApp.config.SRP.KDF
+	user.Salt = authApp.decoyHash("salt", username)[:srp.DefaultSaltLength]
+	user.Verifier = authApp.decoyHash("verifier", username)
+	return
+}
+
+func (authApp *AuthApp) decoyHash(purpose string, username string) []byte {
+	mac := hmac.New(sha256.New, authApp.secret)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(username))
+	return mac.Sum(nil)
+}
+
 // Handle SRP ephemeral exchange
-func (authApp *AuthApp) handleEphemeral(req *request) (res response, err error) {
+func (authApp *AuthApp) handleEphemeral(ctx context.Context, req *request) (res response, err error) {
 	var packet ServerEphemeral
 	err = packet.UnmarshalBinary(req.message)
 	if err != nil {
 		return
 	}
 
+	// Ensure that the game server is not flooding us.
+	if !authApp.sourceLimiter.Allow(addressIP(req.address).String()) {
+		return authApp.sessionError(req, packet.Session, SessionErrorTryLater)
+	}
+
 	// Get session if it exists
-	authApp.sessionsMutex.Lock()
-	session, exists := authApp.sessions[packet.session]
-	if exists == false {
-		authApp.sessionsMutex.Unlock()
-		err = errors.New("session does not exist")
+	session, err := authApp.findSession(ctx, req, packet.Session)
+	if err == ErrSessionNoExist {
+		return authApp.sessionError(req, packet.Session, SessionErrorNoExist)
+	} else if err != nil {
 		return
 	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	// Our response might have been lost, so answer a retransmitted request
+	// the same way as before.
+	if session.EphemeralReply.Matches(req.message) {
+		res.address = req.address
+		res.message = session.EphemeralReply.Response
+		return
+	}
+
+	// A session only accepts a single ephemeral value.
+	if session.State != SessionNegotiated {
+		return authApp.failSession(ctx, req, session, SessionErrorAuthFailed)
+	}
 
 	// Save client A and generate B
-	_, err = session.ComputeKey(packet.ephemeral)
+	_, err = session.SRP.ComputeKey(packet.Ephemeral)
 	if err != nil {
-		authApp.sessionsMutex.Unlock()
 		return
 	}
-	serverEphemeral := session.GetB()
-	authApp.sessionsMutex.Unlock()
+	serverEphemeral := session.SRP.GetB()
 
 	// Assemble response
 	var resPacket AuthEphemeral
-	resPacket.session = packet.session
-	resPacket.ephemeral = serverEphemeral
+	resPacket.Session = packet.Session
+	resPacket.Ephemeral = serverEphemeral
 	message, err := resPacket.MarshalBinary()
 	if err != nil {
 		return
 	}
 
+	session.State = SessionEphemeral
+	session.EphemeralReply = NewSessionReply(req.message, message)
+	err = authApp.sessions.Update(ctx, session)
+	if err == ErrSessionConflict {
+		return authApp.replaySession(ctx, req, packet.Session, func(session *AuthSession) SessionReply {
+			return session.EphemeralReply
+		})
+	} else if err != nil {
+		return
+	}
+
 	res.address = req.address
 	res.message = message
 
@@ -250,7 +657,7 @@ func (authApp *AuthApp) handleEphemeral(req *request) (res response, err error)
 }
 
 // Handle SRP proof exchange
-func (authApp *AuthApp) handleProof(req *request) (res response, err error) {
+func (authApp *AuthApp) handleProof(ctx context.Context, req *request) (res response, err error) {
 	var packet ServerProof
 	err = packet.UnmarshalBinary(req.message)
 	if err != nil {
@@ -258,39 +665,191 @@ func (authApp *AuthApp) handleProof(req *request) (res response, err error) {
 	}
 
 	// Get session if it exists
-	authApp.sessionsMutex.Lock()
-	session, exists := authApp.sessions[packet.session]
-	if exists == false {
-		authApp.sessionsMutex.Unlock()
-		err = errors.New("session does not exist")
+	session, err := authApp.findSession(ctx, req, packet.Session)
+	if err == ErrSessionNoExist {
+		return authApp.sessionError(req, packet.Session, SessionErrorNoExist)
+	} else if err != nil {
+		return
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	// Our response might have been lost, so answer a retransmitted request
+	// the same way as before.
+	if session.ProofReply.Matches(req.message) {
+		res.address = req.address
+		res.message = session.ProofReply.Response
 		return
 	}
 
-	// Verify the client's M1 and generate M2
-	if session.VerifyClientAuthenticator(packet.proof) == false {
-		authApp.sessionsMutex.Unlock()
+	// The proof can only be checked once the ephemeral values are exchanged.
+	if session.State != SessionEphemeral {
+		return authApp.failSession(ctx, req, session, SessionErrorAuthFailed)
+	}
 
+	// Verify the client's M1 and generate M2.  Why a user can't log in is
+	// only revealed once they have proven their password, so that nobody
+	// else can tell which users exist.
+	if session.Decoy || session.SRP.VerifyClientAuthenticator(packet.Proof) == false {
 		// Authentication failed
-		var resPacket SessionError
-		resPacket.session = packet.session
-		resPacket.errType = SessionErrorAuthFailed
-		message, err := resPacket.MarshalBinary()
-		if err != nil {
+		res, err = authApp.sessionError(req, packet.Session, SessionErrorAuthFailed)
+	} else if session.Unsafe {
+		// The user needs a new verifier before they can log in.
+		res, err = authApp.sessionError(req, packet.Session, SessionErrorVerifierUnsafe)
+	} else {
+		res, err = authApp.authProof(ctx, req, session, packet.Proof)
+	}
+	if err != nil {
+		return
+	}
+
+	// The session is over, but is kept until it expires in case the
+	// response is lost.
+	session.State = SessionCompleted
+	session.ProofReply = NewSessionReply(req.message, res.message)
+	err = authApp.sessions.Update(ctx, session)
+	if err == ErrSessionConflict {
+		return authApp.replaySession(ctx, req, packet.Session, func(session *AuthSession) SessionReply {
+			return session.ProofReply
+		})
+	}
+	return
+}
+
+// Respond with the server's proof, if the user is allowed to authenticate.
+func (authApp *AuthApp) authProof(ctx context.Context, req *request, session *AuthSession, clientProof []byte) (res response, err error) {
+	// The user is looked up again, in case they changed during the session.
+	user, err := authApp.database.FindUserByName(ctx, session.User.Username)
+	if err == sql.ErrNoRows {
+		return authApp.sessionError(req, session.ID, SessionErrorAuthFailed)
+	} else if err != nil {
+		return
+	}
+	if errType, ok := authApp.policy.Check(user); !ok {
+		return authApp.sessionError(req, session.ID, errType)
+	}
+
+	var resPacket AuthProof
+	resPacket.Version = session.Version
+	resPacket.Session = session.ID
+	resPacket.Proof = session.SRP.ComputeAuthenticator(clientProof)
+	if session.Version >= 3 {
+		resPacket.Username = user.Username
+		resPacket.Access = user.Access
+
+		// Users imported from elsewhere might not have a profile, which
+		// shouldn't keep them from logging in.
+		profile, err := authApp.database.FindProfile(ctx, user.ID)
+		if err == sql.ErrNoRows {
+			log.Printf("[WARNING] User %d has no profile", user.ID)
+		} else if err != nil {
 			return res, err
+		} else {
+			resPacket.Clantag = profile.Clantag
+			resPacket.Country = profile.Country
 		}
+	}
+	message, err := resPacket.MarshalBinary()
+	if err != nil {
+		return
+	}
 
-		res.address = req.address
-		res.message = message
+	res.address = req.address
+	res.message = message
+
+	return
+}
 
-		return res, err
+// Answer a request that another worker handled at the same time, such as a
+// retransmission, the way that worker did.  Any other request that lost the
+// race is dropped.
+func (authApp *AuthApp) replaySession(ctx context.Context, req *request, id uint32, reply func(*AuthSession) SessionReply) (res response, err error) {
+	session, err := authApp.findSession(ctx, req, id)
+	if err != nil {
+		return
 	}
-	serverProof := session.ComputeAuthenticator(packet.proof)
-	authApp.sessionsMutex.Unlock()
 
-	// Assemble response
-	var resPacket AuthProof
-	resPacket.session = packet.session
-	resPacket.proof = serverProof
+	sessionReply := reply(session)
+	if !sessionReply.Matches(req.message) {
+		err = fmt.Errorf("session %d was changed by another request", id)
+		return
+	}
+
+	res.address = req.address
+	res.message = sessionReply.Response
+	return
+}
+
+// Get a session, ensuring that it belongs to the game server that sent the
+// request.  Sessions belonging to other game servers do not exist as far as
+// the sender is concerned.
+func (authApp *AuthApp) findSession(ctx context.Context, req *request, id uint32) (session *AuthSession, err error) {
+	session, err = authApp.sessions.Get(ctx, id)
+	if err != nil {
+		return
+	}
+
+	if session.Address.Network() != req.address.Network() || session.Address.String() != req.address.String() {
+		log.Printf("[WARNING] %s tried to use session %d belonging to %s", req.address, id, session.Address)
+		return nil, ErrSessionNoExist
+	}
+	return
+}
+
+// Get the IP address that a request came from.
+func addressIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// Create a new random session ID
+func randomSessionID() (sessionID uint32, err error) {
+	sessionBytes := make([]byte, 4)
+	_, err = rand.Read(sessionBytes)
+	if err != nil {
+		return
+	}
+	sessionID = binary.LittleEndian.Uint32(sessionBytes)
+	return
+}
+
+// Abandon a session that can't continue, and respond with a session error.
+func (authApp *AuthApp) failSession(ctx context.Context, req *request, session *AuthSession, errType SessionErrorType) (res response, err error) {
+	session.State = SessionCompleted
+	err = authApp.sessions.Delete(ctx, session.ID)
+	if err != nil {
+		return
+	}
+
+	return authApp.sessionError(req, session.ID, errType)
+}
+
+// Respond with a user error
+func (authApp *AuthApp) userError(req *request, clientSession uint32, errType UserErrorType) (res response, err error) {
+	var resPacket UserError
+	resPacket.ErrType = errType
+	resPacket.ClientSession = clientSession
+	message, err := resPacket.MarshalBinary()
+	if err != nil {
+		return
+	}
+
+	res.address = req.address
+	res.message = message
+
+	return
+}
+
+// Respond with a session error
+func (authApp *AuthApp) sessionError(req *request, session uint32, errType SessionErrorType) (res response, err error) {
+	var resPacket SessionError
+	resPacket.ErrType = errType
+	resPacket.Session = session
 	message, err := resPacket.MarshalBinary()
 	if err != nil {
 		return
@@ -19,16 +19,27 @@
 package charon
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/AlexMax/charon/srp"
 )
 
 func TestRouterShortMessage(t *testing.T) {
 	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
 	req := request{addr, []byte("\x01")}
 
-	app, err := NewAuthApp(NewConfig(nil))
-	_, err = app.router(&req)
+	config := NewConfig(nil)
+	app, err := NewAuthApp(config, newTestDatabase(t, config))
+	_, err = app.router(context.Background(), &req)
 	if err == nil {
 		t.Errorf("%v was incorrectly routed as valid request", req)
 	}
@@ -40,31 +51,23 @@ func TestRouterHandleNegotiate(t *testing.T) {
 
 	// Assemble packet
 	var packet ServerNegotiate
-	packet.username = "username"
-	packet.version = 2
-	packet.clientSession = 4293844428
+	packet.Username = "username"
+	packet.Version = 2
+	packet.ClientSession = 4293844428
 	actual, _ := packet.MarshalBinary()
 
 	// Create auth app with fixture
-	app, err := NewAuthApp(NewConfig(nil))
-	if err != nil {
-		t.Errorf("%s", err.Error())
-	}
-
-	err = app.database.AddUser("username", "charontest@mailinator.com", "password")
-	if err != nil {
-		t.Errorf("%s", err.Error())
-	}
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
 
 	// Assemble UDP request
 	req := request{addr, actual}
-	route, err := app.router(&req)
+	route, err := app.router(context.Background(), &req)
 	if err != nil {
 		t.Errorf("Request was incorrectly routed (%v)", err)
 	}
 
 	// Route request
-	res, err := route(&req)
+	res, err := route(context.Background(), &req)
 	if err != nil {
 		t.Errorf("Route returned an error (%v)", err)
 	}
@@ -75,13 +78,1175 @@ func TestRouterHandleNegotiate(t *testing.T) {
 	if err != nil {
 		t.Errorf("Response did not unmarshall correctly")
 	}
-	if resPacket.username != packet.username {
+	if resPacket.Username != packet.Username {
 		t.Errorf("Incorrect username")
 	}
-	if resPacket.version != 2 {
+	if resPacket.Version != 2 {
 		t.Errorf("Incorrect version")
 	}
-	if resPacket.clientSession != packet.clientSession {
+	if resPacket.ClientSession != packet.ClientSession {
 		t.Errorf("Incorrect clientSession")
 	}
 }
+
+// Users that aren't allowed to log in only find out once they have proven
+// their password.
+func TestHandshakePolicy(t *testing.T) {
+	tests := []struct {
+		access  string
+		active  bool
+		errType SessionErrorType
+	}{
+		{UserAccessUnverified, true, SessionErrorUnverified},
+		{UserAccessUser, false, SessionErrorInactive},
+	}
+
+	for _, test := range tests {
+		app, user := newTestAuthApp(t, nil, test.access)
+		user.Active = test.active
+		err := app.database.UpdateUser(context.Background(), user)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+
+		for password, errType := range map[string]SessionErrorType{"password": test.errType, "wrong": SessionErrorAuthFailed} {
+			var sessionError SessionError
+			err = sessionError.UnmarshalBinary(handshake(t, app, ProtocolVersion, "username", password))
+			if err != nil {
+				t.Fatalf("SessionError did not unmarshall correctly (%v)", err)
+			}
+			if sessionError.ErrType != errType {
+				t.Errorf("%+v with password %s: error type is %v instead of %v", test, password, sessionError.ErrType, errType)
+			}
+		}
+	}
+}
+
+// newTestAuthApp creates an auth app containing a single active user.  A nil
+// config uses the defaults.
+func newTestAuthApp(t testing.TB, config *Config, access string) (app *AuthApp, user *User) {
+	if config == nil {
+		config = NewConfig(nil)
+	}
+	app, err := NewAuthApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	err = app.database.AddUser(context.Background(), "username", "charontest@mailinator.com", "password")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	user, err = app.database.FindUser(context.Background(), "username")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	user.Access = access
+	user.Active = true
+	err = app.database.UpdateUser(context.Background(), user)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	return
+}
+
+// routeMessage routes a single message through the auth app.
+func routeMessage(t *testing.T, app *AuthApp, addr *net.UDPAddr, message []byte) []byte {
+	req := request{addr, message}
+	route, err := app.router(context.Background(), &req)
+	if err != nil {
+		t.Fatalf("Request was incorrectly routed (%v)", err)
+	}
+
+	res, err := route(context.Background(), &req)
+	if err != nil {
+		t.Fatalf("Route returned an error (%v)", err)
+	}
+
+	return res.message
+}
+
+// handshake runs a complete SRP handshake against the auth app.
+func handshake(t *testing.T, app *AuthApp, version uint8, username string, password string) (message []byte) {
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+
+	negotiate := ServerNegotiate{Version: version, ClientSession: 1234, Username: username}
+	message, _ = negotiate.MarshalBinary()
+	message = routeMessage(t, app, addr, message)
+
+	var authNegotiate AuthNegotiate
+	err := authNegotiate.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("AuthNegotiate did not unmarshall correctly (%v)", err)
+	}
+
+	srpo, err := NewSRP(authNegotiate.Group, authNegotiate.Hash, authNegotiate.KDF)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	cs := srpo.NewClientSession([]byte(authNegotiate.Username), []byte(password))
+
+	ephemeral := ServerEphemeral{Session: authNegotiate.Session, Ephemeral: cs.GetA()}
+	message, _ = ephemeral.MarshalBinary()
+	message = routeMessage(t, app, addr, message)
+
+	var authEphemeral AuthEphemeral
+	err = authEphemeral.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("AuthEphemeral did not unmarshall correctly (%v)", err)
+	}
+
+	_, err = cs.ComputeKey(authNegotiate.Salt, authEphemeral.Ephemeral)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	proof := ServerProof{Session: authNegotiate.Session, Proof: cs.ComputeAuthenticator()}
+	message, _ = proof.MarshalBinary()
+	return routeMessage(t, app, addr, message)
+}
+
+func TestHandshakeV2(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessOp)
+
+	var authProof AuthProof
+	err := authProof.UnmarshalBinary(handshake(t, app, 2, "username", "password"))
+	if err != nil {
+		t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+	}
+	if authProof.Version != 2 {
+		t.Errorf("Version is %v instead of 2", authProof.Version)
+	}
+	if authProof.Access != "" {
+		t.Errorf("Access was sent to a version 2 game server")
+	}
+}
+
+func TestHandshakeV3(t *testing.T) {
+	app, user := newTestAuthApp(t, nil, UserAccessOp)
+
+	profile, err := app.database.FindProfile(context.Background(), user.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	profile.Clantag = "TAG"
+	profile.Country = "CA"
+	err = app.database.UpdateProfile(context.Background(), profile)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	var authProof AuthProof
+	err = authProof.UnmarshalBinary(handshake(t, app, 3, "UserName", "password"))
+	if err != nil {
+		t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+	}
+	if authProof.Version != 3 {
+		t.Errorf("Version is %v instead of 3", authProof.Version)
+	}
+	if authProof.Username != "username" {
+		t.Errorf("Username is %v instead of username", authProof.Username)
+	}
+	if authProof.Access != UserAccessOp {
+		t.Errorf("Access is %v instead of %v", authProof.Access, UserAccessOp)
+	}
+	if authProof.Clantag != "TAG" {
+		t.Errorf("Clantag is %v instead of TAG", authProof.Clantag)
+	}
+	if authProof.Country != "CA" {
+		t.Errorf("Country is %v instead of CA", authProof.Country)
+	}
+}
+
+// Every user has a profile, so a missing one is an error rather than an
+// empty profile.
+func TestHandshakeV3NoProfile(t *testing.T) {
+	app, user := newTestAuthApp(t, nil, UserAccessUser)
+
+	_, err := app.database.(*Database).db.Exec("DELETE FROM Profiles WHERE UserId = ?", user.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// The user still logs in, with a blank profile.
+	var authProof AuthProof
+	err = authProof.UnmarshalBinary(handshake(t, app, 3, "username", "password"))
+	if err != nil {
+		t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+	}
+	if authProof.Username != "username" || authProof.Clantag != "" || authProof.Country != "" {
+		t.Errorf("Proof without a profile is %+v", authProof)
+	}
+}
+
+func TestHandshakeGroup(t *testing.T) {
+	config := NewConfig(nil)
+	config.SRP.Group = "rfc5054.3072"
+	config.SRP.Hash = "sha512"
+	app, _ := newTestAuthApp(t, config, UserAccessUser)
+
+	// Version 3 game servers are told which group and hash to use.
+	var authProof AuthProof
+	err := authProof.UnmarshalBinary(handshake(t, app, 3, "username", "password"))
+	if err != nil {
+		t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+	}
+
+	// Version 2 game servers can't be, so the user can't log in.
+	var sessionError SessionError
+	err = sessionError.UnmarshalBinary(handshake(t, app, 2, "username", "password"))
+	if err != nil {
+		t.Fatalf("SessionError did not unmarshall correctly (%v)", err)
+	}
+	if sessionError.ErrType != SessionErrorAuthFailed {
+		t.Errorf("Error type is %v instead of %v", sessionError.ErrType, SessionErrorAuthFailed)
+	}
+}
+
+func TestHandshakeKDF(t *testing.T) {
+	config := NewConfig(nil)
+	config.SRP.KDF = "scrypt:N=1024,r=8,p=1"
+	app, _ := newTestAuthApp(t, config, UserAccessUser)
+
+	// Version 3 game servers are told which key derivation to use.
+	var authProof AuthProof
+	err := authProof.UnmarshalBinary(handshake(t, app, 3, "username", "password"))
+	if err != nil {
+		t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+	}
+
+	// Version 2 game servers can't be, so the user can't log in.
+	var sessionError SessionError
+	err = sessionError.UnmarshalBinary(handshake(t, app, 2, "username", "password"))
+	if err != nil {
+		t.Fatalf("SessionError did not unmarshall correctly (%v)", err)
+	}
+	if sessionError.ErrType != SessionErrorAuthFailed {
+		t.Errorf("Error type is %v instead of %v", sessionError.ErrType, SessionErrorAuthFailed)
+	}
+}
+
+// Version 2 game servers can't tell users with newer parameters apart from
+// users that don't exist, while users with the legacy parameters can still
+// log in through them.
+func TestHandshakeV2Enumeration(t *testing.T) {
+	config := NewConfig(nil)
+	config.SRP.KDF = "scrypt:N=1024,r=8,p=1"
+	app, user := newTestAuthApp(t, config, UserAccessUser)
+
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+	negotiate := func(username string) (message []byte, authNegotiate AuthNegotiate) {
+		negotiate := ServerNegotiate{Version: 2, ClientSession: 1234, Username: username}
+		message, _ = negotiate.MarshalBinary()
+		message = routeMessage(t, app, addr, message)
+		err := authNegotiate.UnmarshalBinary(message)
+		if err != nil {
+			t.Fatalf("AuthNegotiate did not unmarshall correctly (%v)", err)
+		}
+		return
+	}
+
+	// Both get a session with the legacy parameters.
+	existing, existingNegotiate := negotiate("username")
+	unknown, unknownNegotiate := negotiate("usernamf")
+	if len(existing) != len(unknown) || len(existingNegotiate.Salt) != len(unknownNegotiate.Salt) {
+		t.Errorf("Replies for existing and unknown users differ in length")
+	}
+	if !isLegacySRP(existingNegotiate.Group, existingNegotiate.Hash, existingNegotiate.KDF) {
+		t.Errorf("Reply has parameters %s, %s, %s instead of the legacy ones",
+			existingNegotiate.Group, existingNegotiate.Hash, existingNegotiate.KDF)
+	}
+
+	// The salt is the same one a newer game server would see.
+	if !bytes.Equal(existingNegotiate.Salt, user.Salt) {
+		t.Errorf("Salt differs from the user's salt")
+	}
+
+	existingNegotiate.Session, unknownNegotiate.Session = 0, 0
+	existingNegotiate.Salt, unknownNegotiate.Salt = nil, nil
+	existingNegotiate.Username, unknownNegotiate.Username = "", ""
+	if !reflect.DeepEqual(existingNegotiate, unknownNegotiate) {
+		t.Errorf("Replies for existing and unknown users differ (%+v, %+v)", existingNegotiate, unknownNegotiate)
+	}
+
+	// The user can't log in, just like with a wrong password.
+	var sessionError SessionError
+	err := sessionError.UnmarshalBinary(handshake(t, app, 2, "username", "password"))
+	if err != nil {
+		t.Fatalf("SessionError did not unmarshall correctly (%v)", err)
+	}
+	if sessionError.ErrType != SessionErrorAuthFailed {
+		t.Errorf("Error type is %v instead of %v", sessionError.ErrType, SessionErrorAuthFailed)
+	}
+
+	// A user whose verifier still uses the legacy parameters can.
+	srpo, err := NewSRP(LegacySRPGroup, LegacySRPHash, LegacyKDF)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	salt, verifier, err := srpo.ComputeVerifier([]byte("username"), []byte("password"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = app.database.(*Database).db.Exec("UPDATE Users SET salt = ?, verifier = ?, kdf = ? WHERE id = ?", salt, verifier, LegacyKDF, user.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var authProof AuthProof
+	err = authProof.UnmarshalBinary(handshake(t, app, 2, "username", "password"))
+	if err != nil {
+		t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+	}
+}
+
+func TestHandshakeUnsafeGroup(t *testing.T) {
+	config := NewConfig(nil)
+	config.SRP.Group = "rfc5054.3072"
+	config.SRP.MinGroupSize = 3072
+	app, user := newTestAuthApp(t, config, UserAccessUser)
+
+	// The user's verifier is in a group that is now too small.
+	srpo, err := NewSRP("rfc5054.2048", config.SRP.Hash, config.SRP.KDF)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	salt, verifier, err := srpo.ComputeVerifier([]byte("username"), []byte("password"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = app.database.(*Database).db.Exec("UPDATE Users SET srpGroup = 'rfc5054.2048', salt = ?, verifier = ? WHERE id = ?", salt, verifier, user.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// Only somebody who knows the password finds out.
+	for password, errType := range map[string]SessionErrorType{"password": SessionErrorVerifierUnsafe, "wrong": SessionErrorAuthFailed} {
+		var sessionError SessionError
+		err = sessionError.UnmarshalBinary(handshake(t, app, ProtocolVersion, "username", password))
+		if err != nil {
+			t.Fatalf("SessionError did not unmarshall correctly (%v)", err)
+		}
+		if sessionError.ErrType != errType {
+			t.Errorf("Error type with password %s is %v instead of %v", password, sessionError.ErrType, errType)
+		}
+	}
+}
+
+func TestRouterServerAuth(t *testing.T) {
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+	other, _ := net.ResolveUDPAddr("udp4", "192.0.2.1:16667")
+
+	config := NewConfig(nil)
+	config.Auth.ServerAuth = true
+	app, err := NewAuthApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	server, err := app.database.AddServer(context.Background(), "Test Server", []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	packet := ServerNegotiate{Version: 2, ClientSession: 1234, Username: "username"}
+	message, _ := packet.MarshalBinary()
+
+	tests := []struct {
+		name    string
+		addr    *net.UDPAddr
+		message []byte
+		valid   bool
+	}{
+		{"signed", addr, SignRequest(message, uint32(server.ID), server.Secret), true},
+		{"unsigned", addr, message, false},
+		{"wrong secret", addr, SignRequest(message, uint32(server.ID), []byte("wrong")), false},
+		{"unknown server", addr, SignRequest(message, 9999, server.Secret), false},
+		{"wrong network", other, SignRequest(message, uint32(server.ID), server.Secret), false},
+	}
+
+	for _, test := range tests {
+		req := request{test.addr, test.message}
+		_, err = app.router(context.Background(), &req)
+		if test.valid && err != nil {
+			t.Errorf("%s: request was incorrectly rejected (%v)", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: request was incorrectly routed", test.name)
+		}
+		if test.valid && !bytes.Equal(req.message, message) {
+			t.Errorf("%s: signature was not stripped", test.name)
+		}
+	}
+
+	// Revoked servers are rejected
+	err = app.database.RevokeServer(context.Background(), server.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	req := request{addr, SignRequest(message, uint32(server.ID), server.Secret)}
+	_, err = app.router(context.Background(), &req)
+	if err == nil {
+		t.Errorf("Request from revoked server was incorrectly routed")
+	}
+}
+
+func TestHandshakeNoUser(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+
+	// Negotiation for a missing user must look like a real one.
+	negotiate := func(username string) (authNegotiate AuthNegotiate) {
+		packet := ServerNegotiate{Version: 2, ClientSession: 1234, Username: username}
+		message, _ := packet.MarshalBinary()
+		err := authNegotiate.UnmarshalBinary(routeMessage(t, app, addr, message))
+		if err != nil {
+			t.Fatalf("AuthNegotiate did not unmarshall correctly (%v)", err)
+		}
+		return
+	}
+
+	existing := negotiate("username")
+	first := negotiate("Nobody")
+	second := negotiate("nobody")
+	if first.Username != "nobody" {
+		t.Errorf("Username is %v instead of nobody", first.Username)
+	}
+	if len(first.Salt) != len(existing.Salt) {
+		t.Errorf("Salt is %d bytes instead of %d", len(first.Salt), len(existing.Salt))
+	}
+	if !bytes.Equal(first.Salt, second.Salt) {
+		t.Errorf("Salt for the same missing user changed between negotiations")
+	}
+	if bytes.Equal(first.Salt, negotiate("somebody").Salt) {
+		t.Errorf("Salt is the same for different missing users")
+	}
+
+	// The rest of the handshake proceeds, but the proof always fails.
+	var sessionError SessionError
+	err := sessionError.UnmarshalBinary(handshake(t, app, 2, "nobody", "password"))
+	if err != nil {
+		t.Fatalf("SessionError did not unmarshall correctly (%v)", err)
+	}
+	if sessionError.ErrType != SessionErrorAuthFailed {
+		t.Errorf("Error type is %v instead of %v", sessionError.ErrType, SessionErrorAuthFailed)
+	}
+}
+
+// expectSessionError routes a message and checks that it is answered with a
+// specific SessionError.
+func expectSessionError(t *testing.T, app *AuthApp, addr *net.UDPAddr, message []byte, errType SessionErrorType) {
+	var sessionError SessionError
+	err := sessionError.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("SessionError did not unmarshall correctly (%v)", err)
+	}
+	if sessionError.ErrType != errType {
+		t.Errorf("Error type is %v instead of %v", sessionError.ErrType, errType)
+	}
+}
+
+func TestSessionHijack(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+	attackers := []*net.UDPAddr{
+		{IP: net.IPv4(127, 0, 0, 2), Port: 16667},
+		{IP: net.IPv4(127, 0, 0, 1), Port: 16668},
+	}
+
+	negotiate := ServerNegotiate{Version: 2, ClientSession: 1234, Username: "username"}
+	message, _ := negotiate.MarshalBinary()
+	var authNegotiate AuthNegotiate
+	err := authNegotiate.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("AuthNegotiate did not unmarshall correctly (%v)", err)
+	}
+
+	// Other hosts can't inject an ephemeral value...
+	srpo, _ := srp.NewSRP("rfc5054.2048", sha256.New, nil)
+	attacker := srpo.NewClientSession([]byte("username"), []byte("wrong"))
+	ephemeral := ServerEphemeral{Session: authNegotiate.Session, Ephemeral: attacker.GetA()}
+	message, _ = ephemeral.MarshalBinary()
+	for _, attackerAddr := range attackers {
+		expectSessionError(t, app, attackerAddr, message, SessionErrorNoExist)
+	}
+
+	// ...and the real game server is unaffected.
+	cs := srpo.NewClientSession([]byte("username"), []byte("password"))
+	ephemeral = ServerEphemeral{Session: authNegotiate.Session, Ephemeral: cs.GetA()}
+	message, _ = ephemeral.MarshalBinary()
+	var authEphemeral AuthEphemeral
+	err = authEphemeral.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("AuthEphemeral did not unmarshall correctly (%v)", err)
+	}
+	_, err = cs.ComputeKey(authNegotiate.Salt, authEphemeral.Ephemeral)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// Other hosts can't finish the handshake either, even with a valid proof.
+	proof := ServerProof{Session: authNegotiate.Session, Proof: cs.ComputeAuthenticator()}
+	message, _ = proof.MarshalBinary()
+	for _, attackerAddr := range attackers {
+		expectSessionError(t, app, attackerAddr, message, SessionErrorNoExist)
+	}
+
+	var authProof AuthProof
+	err = authProof.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+	}
+	if !cs.VerifyServerAuthenticator(authProof.Proof) {
+		t.Errorf("Server proof is not valid")
+	}
+}
+
+func TestSessionNoExist(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+
+	ephemeral := ServerEphemeral{Session: 1234, Ephemeral: []byte("ephemeral")}
+	message, _ := ephemeral.MarshalBinary()
+	expectSessionError(t, app, addr, message, SessionErrorNoExist)
+
+	proof := ServerProof{Session: 1234, Proof: []byte("proof")}
+	message, _ = proof.MarshalBinary()
+	expectSessionError(t, app, addr, message, SessionErrorNoExist)
+}
+
+// negotiateSession starts a new session for the test user.
+func negotiateSession(t *testing.T, app *AuthApp, addr *net.UDPAddr) (authNegotiate AuthNegotiate) {
+	negotiate := ServerNegotiate{Version: 2, ClientSession: 1234, Username: "username"}
+	message, _ := negotiate.MarshalBinary()
+	err := authNegotiate.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("AuthNegotiate did not unmarshall correctly (%v)", err)
+	}
+	return
+}
+
+func TestHandshakeOrder(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+	srpo, _ := srp.NewSRP("rfc5054.2048", sha256.New, nil)
+
+	// Proof before ephemeral fails the session.
+	authNegotiate := negotiateSession(t, app, addr)
+	proof := ServerProof{Session: authNegotiate.Session, Proof: []byte("proof")}
+	message, _ := proof.MarshalBinary()
+	expectSessionError(t, app, addr, message, SessionErrorAuthFailed)
+
+	cs := srpo.NewClientSession([]byte("username"), []byte("password"))
+	ephemeral := ServerEphemeral{Session: authNegotiate.Session, Ephemeral: cs.GetA()}
+	message, _ = ephemeral.MarshalBinary()
+	expectSessionError(t, app, addr, message, SessionErrorNoExist)
+
+	// A second, different ephemeral fails the session.
+	authNegotiate = negotiateSession(t, app, addr)
+	ephemeral = ServerEphemeral{Session: authNegotiate.Session, Ephemeral: cs.GetA()}
+	message, _ = ephemeral.MarshalBinary()
+	var authEphemeral AuthEphemeral
+	err := authEphemeral.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("AuthEphemeral did not unmarshall correctly (%v)", err)
+	}
+	other := srpo.NewClientSession([]byte("username"), []byte("password"))
+	ephemeral.Ephemeral = other.GetA()
+	message, _ = ephemeral.MarshalBinary()
+	expectSessionError(t, app, addr, message, SessionErrorAuthFailed)
+
+	// Completed sessions are no longer pending.
+	handshake(t, app, 2, "username", "password")
+	count, err := app.sessions.Pending(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if count != 0 {
+		t.Errorf("%d sessions are still pending", count)
+	}
+}
+
+func TestHandshakeRetransmit(t *testing.T) {
+	for _, store := range []string{"memory", "database"} {
+		config := NewConfig(nil)
+		config.Auth.Secret = "a long and random secret"
+		config.Auth.SessionStore = store
+		app, _ := newTestAuthApp(t, config, UserAccessUser)
+
+		addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+		authNegotiate := negotiateSession(t, app, addr)
+
+		// Each request is sent twice, as if the first response was lost.
+		srpo, _ := srp.NewSRP("rfc5054.2048", sha256.New, nil)
+		cs := srpo.NewClientSession([]byte("username"), []byte("password"))
+		ephemeral := ServerEphemeral{Session: authNegotiate.Session, Ephemeral: cs.GetA()}
+		message, _ := ephemeral.MarshalBinary()
+		first := routeMessage(t, app, addr, message)
+		second := routeMessage(t, app, addr, message)
+		if !bytes.Equal(first, second) {
+			t.Errorf("%s: Retransmitted ephemeral got a different response", store)
+		}
+		var authEphemeral AuthEphemeral
+		err := authEphemeral.UnmarshalBinary(second)
+		if err != nil {
+			t.Fatalf("AuthEphemeral did not unmarshall correctly (%v)", err)
+		}
+
+		_, err = cs.ComputeKey(authNegotiate.Salt, authEphemeral.Ephemeral)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		proof := ServerProof{Session: authNegotiate.Session, Proof: cs.ComputeAuthenticator()}
+		message, _ = proof.MarshalBinary()
+		first = routeMessage(t, app, addr, message)
+		second = routeMessage(t, app, addr, message)
+		if !bytes.Equal(first, second) {
+			t.Errorf("%s: Retransmitted proof got a different response", store)
+		}
+		var authProof AuthProof
+		err = authProof.UnmarshalBinary(second)
+		if err != nil {
+			t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+		}
+		if !cs.VerifyServerAuthenticator(authProof.Proof) {
+			t.Errorf("%s: Server proof is not valid", store)
+		}
+
+		// A different proof for a completed session is not a retransmit.
+		proof.Proof = []byte("proof")
+		message, _ = proof.MarshalBinary()
+		expectSessionError(t, app, addr, message, SessionErrorAuthFailed)
+	}
+}
+
+func TestNewAuthAppSecret(t *testing.T) {
+	config := NewConfig(nil)
+	for _, secret := range []string{"secret", exampleSecret} {
+		config.Auth.Secret = secret
+		_, err := NewAuthApp(config, newTestDatabase(t, config))
+		if err == nil {
+			t.Errorf("Auth app was created with secret %q", secret)
+		}
+	}
+
+	config.Auth.Secret = "a long and random secret"
+	_, err := NewAuthApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+}
+
+func TestDecoyUserSecret(t *testing.T) {
+	config := NewConfig(nil)
+	config.Auth.Secret = "a long and random secret"
+
+	first, err := NewAuthApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	second, err := NewAuthApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// Salts must survive a restart when a secret is configured.
+	if !bytes.Equal(first.decoyUser("nobody").Salt, second.decoyUser("nobody").Salt) {
+		t.Errorf("Salt for a missing user depends on more than the secret")
+	}
+}
+
+func TestRateLimitUser(t *testing.T) {
+	config := NewConfig(nil)
+	config.RateLimit.UserRate = 1
+	config.RateLimit.UserBurst = 1
+	app, err := NewAuthApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+
+	packet := ServerNegotiate{Version: 2, ClientSession: 1234, Username: "username"}
+	message, _ := packet.MarshalBinary()
+
+	var authNegotiate AuthNegotiate
+	err = authNegotiate.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("First negotiation was rejected (%v)", err)
+	}
+
+	var userError UserError
+	err = userError.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("UserError did not unmarshall correctly (%v)", err)
+	}
+	if userError.ErrType != UserErrorTryLater {
+		t.Errorf("Error type is %v instead of %v", userError.ErrType, UserErrorTryLater)
+	}
+
+	// Other users are unaffected
+	packet.Username = "somebody"
+	message, _ = packet.MarshalBinary()
+	err = authNegotiate.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Errorf("Negotiation for another user was rejected (%v)", err)
+	}
+}
+
+// Game servers can't look users up by email address, so an address can't be
+// used to learn a user's name.
+func TestNegotiateEmail(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+
+	for _, email := range []string{"CharonTest@mailinator.com", "nobody@mailinator.com"} {
+		packet := ServerNegotiate{Version: 3, ClientSession: 1234, Username: email}
+		message, _ := packet.MarshalBinary()
+		var authNegotiate AuthNegotiate
+		err := authNegotiate.UnmarshalBinary(routeMessage(t, app, addr, message))
+		if err != nil {
+			t.Fatalf("AuthNegotiate did not unmarshall correctly (%v)", err)
+		}
+		if authNegotiate.Username != strings.ToLower(email) {
+			t.Errorf("Negotiating as %s returned username %s", email, authNegotiate.Username)
+		}
+	}
+}
+
+// Every name for a user shares the same limit.
+func TestRateLimitUserCase(t *testing.T) {
+	config := NewConfig(nil)
+	config.RateLimit.UserRate = 1
+	config.RateLimit.UserBurst = 1
+	app, _ := newTestAuthApp(t, config, UserAccessUser)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+
+	packet := ServerNegotiate{Version: 3, ClientSession: 1234, Username: "username"}
+	message, _ := packet.MarshalBinary()
+	var authNegotiate AuthNegotiate
+	err := authNegotiate.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("First negotiation was rejected (%v)", err)
+	}
+
+	packet.Username = "UserName"
+	message, _ = packet.MarshalBinary()
+	var userError UserError
+	err = userError.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("UserError did not unmarshall correctly (%v)", err)
+	}
+	if userError.ErrType != UserErrorTryLater {
+		t.Errorf("Error type is %v instead of %v", userError.ErrType, UserErrorTryLater)
+	}
+}
+
+func TestRateLimitSource(t *testing.T) {
+	config := NewConfig(nil)
+	config.RateLimit.SourceRate = 1
+	config.RateLimit.SourceBurst = 1
+	app, err := NewAuthApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+
+	negotiate := ServerNegotiate{Version: 2, ClientSession: 1234, Username: "username"}
+	message, _ := negotiate.MarshalBinary()
+
+	var authNegotiate AuthNegotiate
+	err = authNegotiate.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("Negotiation was rejected (%v)", err)
+	}
+
+	ephemeral := ServerEphemeral{Session: authNegotiate.Session, Ephemeral: []byte{1}}
+	message, _ = ephemeral.MarshalBinary()
+
+	var sessionError SessionError
+	err = sessionError.UnmarshalBinary(routeMessage(t, app, addr, message))
+	if err != nil {
+		t.Fatalf("SessionError did not unmarshall correctly (%v)", err)
+	}
+	if sessionError.ErrType != SessionErrorTryLater {
+		t.Errorf("Error type is %v instead of %v", sessionError.ErrType, SessionErrorTryLater)
+	}
+	if sessionError.Session != authNegotiate.Session {
+		t.Errorf("Session is %v instead of %v", sessionError.Session, authNegotiate.Session)
+	}
+}
+
+// udpExchange sends a request over a UDP connection and waits for the
+// response.
+func udpExchange(conn *net.UDPConn, req []byte) (res []byte, err error) {
+	_, err = conn.Write(req)
+	if err != nil {
+		return
+	}
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return
+	}
+	res = make([]byte, packetBufferSize)
+	msglen, err := conn.Read(res)
+	return res[:msglen], err
+}
+
+// tcpExchange sends a request over a TCP connection and waits for the
+// response.
+func tcpExchange(conn net.Conn, req []byte) (res []byte, err error) {
+	err = WriteStreamMessage(conn, req)
+	if err != nil {
+		return
+	}
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return
+	}
+	return ReadStreamMessage(conn)
+}
+
+// udpHandshake runs a complete SRP handshake over a UDP connection.
+func udpHandshake(conn *net.UDPConn, clientSession uint32, username string, password string) (err error) {
+	return exchangeHandshake(func(req []byte) ([]byte, error) {
+		return udpExchange(conn, req)
+	}, clientSession, username, password)
+}
+
+// exchangeHandshake runs a complete SRP handshake using an exchange function
+// that sends a request and returns the response.
+func exchangeHandshake(exchange func([]byte) ([]byte, error), clientSession uint32, username string, password string) (err error) {
+	negotiate := ServerNegotiate{Version: ProtocolVersion, ClientSession: clientSession, Username: username}
+	message, _ := negotiate.MarshalBinary()
+	message, err = exchange(message)
+	if err != nil {
+		return
+	}
+	var authNegotiate AuthNegotiate
+	err = authNegotiate.UnmarshalBinary(message)
+	if err != nil {
+		return
+	}
+
+	srpo, err := NewSRP(authNegotiate.Group, authNegotiate.Hash, authNegotiate.KDF)
+	if err != nil {
+		return
+	}
+	cs := srpo.NewClientSession([]byte(authNegotiate.Username), []byte(password))
+
+	ephemeral := ServerEphemeral{Session: authNegotiate.Session, Ephemeral: cs.GetA()}
+	message, _ = ephemeral.MarshalBinary()
+	message, err = exchange(message)
+	if err != nil {
+		return
+	}
+	var authEphemeral AuthEphemeral
+	err = authEphemeral.UnmarshalBinary(message)
+	if err != nil {
+		return
+	}
+
+	_, err = cs.ComputeKey(authNegotiate.Salt, authEphemeral.Ephemeral)
+	if err != nil {
+		return
+	}
+
+	proof := ServerProof{Session: authNegotiate.Session, Proof: cs.ComputeAuthenticator()}
+	message, _ = proof.MarshalBinary()
+	message, err = exchange(message)
+	if err != nil {
+		return
+	}
+	var authProof AuthProof
+	err = authProof.UnmarshalBinary(message)
+	if err != nil {
+		return
+	}
+	if !cs.VerifyServerAuthenticator(authProof.Proof) {
+		err = errors.New("server authenticator is not valid")
+	}
+
+	return
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	config := NewConfig(nil)
+	config.RateLimit.SourceRate = 0
+	config.RateLimit.UserRate = 0
+	config.Auth.ShutdownTimeout = time.Second
+	app, _ := newTestAuthApp(b, config, UserAccessUser)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatalf("%s", err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- app.Serve(ctx, conn)
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			b.Errorf("%s", err.Error())
+			return
+		}
+		defer client.Close()
+
+		var clientSession uint32
+		for pb.Next() {
+			clientSession++
+			err = udpHandshake(client, clientSession, "username", "password")
+			if err != nil {
+				b.Errorf("%s", err.Error())
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	cancel()
+	select {
+	case err = <-errs:
+		if err != nil {
+			b.Errorf("Serve returned an error (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		b.Fatalf("Serve did not return after shutdown")
+	}
+
+	stats := app.Stats()
+	b.ReportMetric(float64(stats.Dropped), "dropped")
+}
+
+func TestServeShutdown(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+	app.config.Auth.ShutdownTimeout = time.Second
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- app.Serve(ctx, conn)
+	}()
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer client.Close()
+
+	// Start a session before shutting down.
+	negotiate := ServerNegotiate{Version: 2, ClientSession: 1, Username: "username"}
+	message, _ := negotiate.MarshalBinary()
+	message, err = udpExchange(client, message)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var authNegotiate AuthNegotiate
+	err = authNegotiate.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("AuthNegotiate did not unmarshall correctly (%v)", err)
+	}
+
+	cancel()
+	for atomic.LoadInt32(&app.draining) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// New sessions are turned away.
+	negotiate.ClientSession = 2
+	message, _ = negotiate.MarshalBinary()
+	message, err = udpExchange(client, message)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var userError UserError
+	err = userError.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("UserError did not unmarshall correctly (%v)", err)
+	}
+	if userError.ErrType != UserErrorTryLater {
+		t.Errorf("Error type is %v instead of %v", userError.ErrType, UserErrorTryLater)
+	}
+
+	// The existing session can still finish.
+	srpo, _ := srp.NewSRP("rfc5054.2048", sha256.New, nil)
+	cs := srpo.NewClientSession([]byte(authNegotiate.Username), []byte("password"))
+	ephemeral := ServerEphemeral{Session: authNegotiate.Session, Ephemeral: cs.GetA()}
+	message, _ = ephemeral.MarshalBinary()
+	message, err = udpExchange(client, message)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var authEphemeral AuthEphemeral
+	err = authEphemeral.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("AuthEphemeral did not unmarshall correctly (%v)", err)
+	}
+
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Errorf("Serve returned an error (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after shutdown")
+	}
+}
+
+func TestServeDualStack(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+
+	conn4, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	conn6, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		conn4.Close()
+		t.Skipf("IPv6 loopback is not available (%v)", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- app.Serve(ctx, conn4, conn6)
+	}()
+
+	for i, conn := range []*net.UDPConn{conn4, conn6} {
+		client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		err = udpHandshake(client, uint32(i), "username", "password")
+		if err != nil {
+			t.Errorf("Handshake over %s failed (%v)", conn.LocalAddr(), err)
+		}
+		client.Close()
+	}
+
+	cancel()
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Errorf("Serve returned an error (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after shutdown")
+	}
+}
+
+func TestServeConnectionLost(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+
+	first, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	second, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- app.Serve(context.Background(), first, second)
+	}()
+
+	// Losing one connection stops the whole server.
+	first.Close()
+	select {
+	case err = <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Serve returned %v instead of a closed connection error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after losing a connection")
+	}
+
+	_, _, err = second.ReadFromUDP(make([]byte, 1))
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Remaining connection was not closed")
+	}
+}
+
+func TestServeTCP(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+	app.config.Auth.ShutdownTimeout = 100 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- app.ServeWithTCP(ctx, []*net.UDPConn{conn}, []net.Listener{listener})
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer client.Close()
+
+	// Several handshakes can share one connection.
+	for i := uint32(0); i < 2; i++ {
+		err = exchangeHandshake(func(req []byte) ([]byte, error) {
+			return tcpExchange(client, req)
+		}, i, "username", "password")
+		if err != nil {
+			t.Errorf("Handshake over TCP failed (%v)", err)
+		}
+	}
+
+	// Messages aren't limited to the size of a UDP packet buffer.
+	username := strings.Repeat("x", 2*packetBufferSize)
+	negotiate := ServerNegotiate{Version: ProtocolVersion, ClientSession: 3, Username: username}
+	message, _ := negotiate.MarshalBinary()
+	message, err = tcpExchange(client, message)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	var authNegotiate AuthNegotiate
+	err = authNegotiate.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("AuthNegotiate did not unmarshall correctly (%v)", err)
+	}
+	if authNegotiate.Username != username {
+		t.Errorf("Username was truncated to %d bytes", len(authNegotiate.Username))
+	}
+
+	// UDP still works alongside TCP.
+	udpClient, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer udpClient.Close()
+	err = udpHandshake(udpClient, 4, "username", "password")
+	if err != nil {
+		t.Errorf("Handshake over UDP failed (%v)", err)
+	}
+
+	// Open connections don't hold up shutdown.
+	cancel()
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Errorf("Serve returned an error (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after shutdown")
+	}
+}
@@ -19,7 +19,12 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/AlexMax/charon"
 	"github.com/go-ini/ini"
@@ -35,30 +40,66 @@ func main() {
 		log.Fatal(err)
 	}
 	config := charon.NewConfig(iniFile)
+	err = config.Validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Open the database shared by both servers
+	database, err := charon.NewDatabase(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer database.Close()
+
+	// Shut down cleanly on SIGINT or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, shutting down...", sig)
+		cancel()
+	}()
+
+	var apps sync.WaitGroup
 
 	// Start Authenticator
+	apps.Add(1)
 	go func() {
+		defer apps.Done()
+
 		// Construct application.
-		authApp, err := charon.NewAuthApp(config)
+		authApp, err := charon.NewAuthApp(config, database)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		// Start the auth server.
-		log.Fatal(authApp.ListenAndServe(":16666"))
+		err = authApp.ListenAndServeWithTCP(ctx, config.Auth.Listen, config.Auth.ListenTCP)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}()
 
 	// Start Website
+	apps.Add(1)
 	go func() {
-		webApp, err := charon.NewWebApp(config)
+		defer apps.Done()
+
+		webApp, err := charon.NewWebApp(config, database)
 		if err != nil {
 			log.Fatal(err)
 		}
 
 		// Start the web server.
-		log.Fatal(webApp.ListenAndServe(":8080"))
+		err = webApp.ListenAndServe(ctx, config.Web.Listen...)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}()
 
-	// Sleep forever
-	select {}
+	// Wait for both servers to shut down
+	apps.Wait()
+	log.Print("Charon has shut down.")
 }
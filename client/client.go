@@ -0,0 +1,292 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+// Package client implements the game server side of the Charon
+// authentication protocol.
+package client
+
+import (
+	"crypto/rand"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/AlexMax/charon"
+)
+
+// Default retransmission settings.
+const (
+	DefaultTimeout = time.Second
+	DefaultRetries = 3
+)
+
+// ErrTimeout is returned when the auth server does not respond to a request
+// after all retransmissions have been exhausted.
+var ErrTimeout = errors.New("client: auth server did not respond")
+
+// ErrServerProof is returned when the auth server's proof does not match,
+// meaning the auth server could not prove that it knows the verifier.
+var ErrServerProof = errors.New("client: auth server proof is not valid")
+
+// ErrUsername is returned when the auth server's proof is for a different
+// user than the one whose password was proven.
+var ErrUsername = errors.New("client: auth server proof is for another user")
+
+// Authenticator authenticates users against a Charon auth server.
+// Instances of Authenticator are safe for concurrent use.
+type Authenticator struct {
+	Timeout  time.Duration // How long to wait for each response
+	Retries  int           // How many times to retransmit a request
+	ServerID uint32        // ID of this game server, if registered
+	Secret   []byte        // Secret of this game server, if registered
+	addr     *net.UDPAddr
+}
+
+// Result contains the outcome of a successful authentication.
+type Result struct {
+	Username string // Canonical username the password was proven for
+	Access   string // Access level of the user
+	Clantag  string // Clan tag from the user's profile
+	Country  string // Country from the user's profile
+	Session  uint32 // Session ID assigned by the auth server
+	Key      []byte // Shared SRP session key
+}
+
+// NewAuthenticator creates a new Authenticator for the auth server at the
+// passed address.
+func NewAuthenticator(addr string) (authenticator *Authenticator, err error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+
+	authenticator = new(Authenticator)
+	authenticator.Timeout = DefaultTimeout
+	authenticator.Retries = DefaultRetries
+	authenticator.addr = udpAddr
+	return
+}
+
+// Authenticate runs a complete negotiation, ephemeral and proof exchange for
+// the passed username and password.  If the auth server rejects the attempt,
+// the returned error will be a *charon.UserError or *charon.SessionError.
+func (authenticator *Authenticator) Authenticate(username string, password string) (result *Result, err error) {
+	conn, err := net.DialUDP("udp", nil, authenticator.addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	clientSession, err := randomSession()
+	if err != nil {
+		return
+	}
+
+	// Negotiate a session.
+	negotiate := charon.ServerNegotiate{
+		Version:       charon.ProtocolVersion,
+		ClientSession: clientSession,
+		Username:      username,
+	}
+	var authNegotiate charon.AuthNegotiate
+	err = authenticator.exchange(conn, &negotiate, func(message []byte) (bool, error) {
+		return authenticator.handleNegotiate(message, clientSession, &authNegotiate)
+	})
+	if err != nil {
+		return
+	}
+
+	// The auth server tells us which group, hash and key derivation the
+	// user's verifier was made with.
+	srpo, err := charon.NewSRP(authNegotiate.Group, authNegotiate.Hash, authNegotiate.KDF)
+	if err != nil {
+		return
+	}
+	cs := srpo.NewClientSession([]byte(authNegotiate.Username), []byte(password))
+
+	// Exchange ephemeral values.
+	ephemeral := charon.ServerEphemeral{
+		Session:   authNegotiate.Session,
+		Ephemeral: cs.GetA(),
+	}
+	var authEphemeral charon.AuthEphemeral
+	err = authenticator.exchange(conn, &ephemeral, func(message []byte) (bool, error) {
+		return authenticator.handleSession(message, authNegotiate.Session, &authEphemeral)
+	})
+	if err != nil {
+		return
+	}
+
+	key, err := cs.ComputeKey(authNegotiate.Salt, authEphemeral.Ephemeral)
+	if err != nil {
+		return
+	}
+
+	// Exchange proofs.
+	proof := charon.ServerProof{
+		Session: authNegotiate.Session,
+		Proof:   cs.ComputeAuthenticator(),
+	}
+	var authProof charon.AuthProof
+	err = authenticator.exchange(conn, &proof, func(message []byte) (bool, error) {
+		return authenticator.handleSession(message, authNegotiate.Session, &authProof)
+	})
+	if err != nil {
+		return
+	}
+
+	if !cs.VerifyServerAuthenticator(authProof.Proof) {
+		err = ErrServerProof
+		return
+	}
+
+	// The proofs cover the username the password was combined with, so
+	// only trust a name from the server that matches it.  Version 2 auth
+	// servers don't send one.
+	if authNegotiate.Version >= 3 && authProof.Username != authNegotiate.Username {
+		err = ErrUsername
+		return
+	}
+
+	result = &Result{
+		Username: authNegotiate.Username,
+		Access:   authProof.Access,
+		Clantag:  authProof.Clantag,
+		Country:  authProof.Country,
+		Session:  authNegotiate.Session,
+		Key:      key,
+	}
+	return
+}
+
+// exchange sends a request and waits for a response that the passed handler
+// accepts, retransmitting the request every time the timeout expires.
+func (authenticator *Authenticator) exchange(conn *net.UDPConn, req encoding.BinaryMarshaler, handler func([]byte) (bool, error)) (err error) {
+	message, err := req.MarshalBinary()
+	if err != nil {
+		return
+	}
+	if authenticator.Secret != nil {
+		message = charon.SignRequest(message, authenticator.ServerID, authenticator.Secret)
+	}
+
+	buffer := make([]byte, 65536)
+	for attempt := 0; attempt <= authenticator.Retries; attempt++ {
+		_, err = conn.Write(message)
+		if err != nil {
+			return
+		}
+
+		deadline := time.Now().Add(authenticator.Timeout)
+		err = conn.SetReadDeadline(deadline)
+		if err != nil {
+			return
+		}
+
+		for {
+			var msglen int
+			msglen, err = conn.Read(buffer)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return
+			}
+
+			var done bool
+			done, err = handler(buffer[:msglen])
+			if done {
+				return
+			}
+		}
+	}
+
+	return ErrTimeout
+}
+
+// handleNegotiate accepts an AuthNegotiate or UserError for our client
+// session.
+func (authenticator *Authenticator) handleNegotiate(message []byte, clientSession uint32, res *charon.AuthNegotiate) (bool, error) {
+	switch header(message) {
+	case charon.CharonAuthNegotiate:
+		err := res.UnmarshalBinary(message)
+		if err != nil || res.ClientSession != clientSession {
+			return false, nil
+		}
+		return true, nil
+	case charon.CharonUserError:
+		userError := new(charon.UserError)
+		err := userError.UnmarshalBinary(message)
+		if err != nil || userError.ClientSession != clientSession {
+			return false, nil
+		}
+		return true, userError
+	}
+
+	return false, nil
+}
+
+// handleSession accepts the expected response or a SessionError for our
+// session.
+func (authenticator *Authenticator) handleSession(message []byte, session uint32, res encoding.BinaryUnmarshaler) (bool, error) {
+	switch header(message) {
+	case charon.CharonAuthEphemeral:
+		packet, ok := res.(*charon.AuthEphemeral)
+		if !ok || packet.UnmarshalBinary(message) != nil || packet.Session != session {
+			return false, nil
+		}
+		return true, nil
+	case charon.CharonAuthProof:
+		packet, ok := res.(*charon.AuthProof)
+		if !ok || packet.UnmarshalBinary(message) != nil || packet.Session != session {
+			return false, nil
+		}
+		return true, nil
+	case charon.CharonSessionError:
+		sessionError := new(charon.SessionError)
+		err := sessionError.UnmarshalBinary(message)
+		if err != nil || sessionError.Session != session {
+			return false, nil
+		}
+		return true, sessionError
+	}
+
+	return false, nil
+}
+
+// header returns the packet type of a message, or zero if the message is too
+// short to have one.
+func header(message []byte) uint32 {
+	if len(message) < 4 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(message[:4])
+}
+
+// randomSession creates a random client session ID.
+func randomSession() (session uint32, err error) {
+	sessionBytes := make([]byte, 4)
+	_, err = rand.Read(sessionBytes)
+	if err != nil {
+		return
+	}
+	session = binary.LittleEndian.Uint32(sessionBytes)
+	return
+}
@@ -0,0 +1,259 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexMax/charon"
+)
+
+// startAuthApp starts an auth server on a random loopback port that contains
+// a single user.
+func startAuthApp(t *testing.T) (addr string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "charon")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := charon.NewConfig(nil)
+	config.Database.Filename = filepath.Join(dir, "charon.db")
+
+	database, err := charon.NewDatabase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = database.AddUser(context.Background(), "username", "charontest@mailinator.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := database.FindUser(context.Background(), "username")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Access = charon.UserAccessUser
+	user.Active = true
+	err = database.UpdateUser(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, err := charon.NewAuthApp(config, database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Serve(context.Background(), conn)
+
+	return conn.LocalAddr().String(), func() {
+		conn.Close()
+		database.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// startV2Relay starts a relay to the auth server at addr that asks for
+// version 2 of the protocol in every negotiation, as if the auth server
+// didn't speak anything newer.
+func startV2Relay(t *testing.T, addr string) (relayAddr string, cleanup func()) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream, err := net.DialUDP("udp", nil, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			n, client, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			message := buffer[:n]
+			var negotiate charon.ServerNegotiate
+			if negotiate.UnmarshalBinary(message) == nil {
+				negotiate.Version = 2
+				message, _ = negotiate.MarshalBinary()
+			}
+			upstream.Write(message)
+
+			upstream.SetReadDeadline(time.Now().Add(time.Second))
+			n, err = upstream.Read(buffer)
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(buffer[:n], client)
+		}
+	}()
+
+	return conn.LocalAddr().String(), func() {
+		conn.Close()
+		upstream.Close()
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	addr, cleanup := startAuthApp(t)
+	defer cleanup()
+
+	authenticator, err := NewAuthenticator(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := authenticator.Authenticate("UserName", "password")
+	if err != nil {
+		t.Fatalf("Authentication failed (%v)", err)
+	}
+	if result.Username != "username" {
+		t.Errorf("Username is %v instead of username", result.Username)
+	}
+	if result.Access != charon.UserAccessUser {
+		t.Errorf("Access is %v instead of %v", result.Access, charon.UserAccessUser)
+	}
+	if len(result.Key) == 0 {
+		t.Errorf("Session key is empty")
+	}
+
+	// Email addresses are not usernames, so they can't be used to learn
+	// which user they belong to.
+	result, err = authenticator.Authenticate("CharonTest@mailinator.com", "password")
+	if result != nil {
+		t.Errorf("Logging in by email returned username %v", result.Username)
+	}
+	sessionError, ok := err.(*charon.SessionError)
+	if !ok {
+		t.Fatalf("Expected a SessionError, got %v", err)
+	}
+	if sessionError.ErrType != charon.SessionErrorAuthFailed {
+		t.Errorf("Error type is %v instead of %v", sessionError.ErrType, charon.SessionErrorAuthFailed)
+	}
+}
+
+// Version 2 auth servers don't send the username with their proof, so the
+// negotiated one is used.
+func TestAuthenticateV2(t *testing.T) {
+	addr, cleanup := startAuthApp(t)
+	defer cleanup()
+	relay, stop := startV2Relay(t, addr)
+	defer stop()
+
+	authenticator, err := NewAuthenticator(relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := authenticator.Authenticate("UserName", "password")
+	if err != nil {
+		t.Fatalf("Authentication failed (%v)", err)
+	}
+	if result.Username != "username" {
+		t.Errorf("Username is %v instead of username", result.Username)
+	}
+	if result.Access != "" {
+		t.Errorf("Access is %v instead of being empty", result.Access)
+	}
+}
+
+func TestAuthenticateBadPassword(t *testing.T) {
+	addr, cleanup := startAuthApp(t)
+	defer cleanup()
+
+	authenticator, err := NewAuthenticator(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = authenticator.Authenticate("username", "wrong")
+	sessionError, ok := err.(*charon.SessionError)
+	if !ok {
+		t.Fatalf("Expected a SessionError, got %v", err)
+	}
+	if sessionError.ErrType != charon.SessionErrorAuthFailed {
+		t.Errorf("Error type is %v instead of %v", sessionError.ErrType, charon.SessionErrorAuthFailed)
+	}
+}
+
+func TestAuthenticateNoUser(t *testing.T) {
+	addr, cleanup := startAuthApp(t)
+	defer cleanup()
+
+	authenticator, err := NewAuthenticator(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing users are indistinguishable from a bad password.
+	_, err = authenticator.Authenticate("nobody", "password")
+	sessionError, ok := err.(*charon.SessionError)
+	if !ok {
+		t.Fatalf("Expected a SessionError, got %v", err)
+	}
+	if sessionError.ErrType != charon.SessionErrorAuthFailed {
+		t.Errorf("Error type is %v instead of %v", sessionError.ErrType, charon.SessionErrorAuthFailed)
+	}
+}
+
+func TestAuthenticateTimeout(t *testing.T) {
+	// A socket that never answers.
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	authenticator, err := NewAuthenticator(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator.Timeout = 10 * time.Millisecond
+	authenticator.Retries = 2
+
+	_, err = authenticator.Authenticate("username", "password")
+	if err != ErrTimeout {
+		t.Errorf("Expected %v, got %v", ErrTimeout, err)
+	}
+
+	// Every attempt should have been sent.
+	buffer := make([]byte, 1024)
+	for i := 0; i <= authenticator.Retries; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = conn.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatalf("Attempt %d was not sent (%v)", i+1, err)
+		}
+	}
+}
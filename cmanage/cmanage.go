@@ -19,10 +19,13 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"math/big"
 	"os"
+	"time"
 
 	"github.com/AlexMax/charon"
 	"github.com/go-ini/ini"
@@ -35,6 +38,16 @@ const passwordLetters = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKMNPQRSTUVWXYZ23456789"
 func main() {
 	cmd := cli.App("cmanage", "Manage a charon database")
 	cmd.Command("adduser", "Add a user to the database", addUser)
+	cmd.Command("migrate", "Manage the database schema", func(cmd *cli.Cmd) {
+		cmd.Command("up", "Apply migrations up to a version, the latest by default", migrateUp)
+		cmd.Command("down", "Revert migrations down to a version, the previous one by default", migrateDown)
+		cmd.Command("status", "List migrations and whether they have been applied", migrateStatus)
+	})
+	cmd.Command("server", "Manage game servers trusted by the auth server", func(cmd *cli.Cmd) {
+		cmd.Command("add", "Register a new game server", addServer)
+		cmd.Command("rotate", "Generate a new secret for a game server", rotateServer)
+		cmd.Command("revoke", "Revoke a game server", revokeServer)
+	})
 	cmd.Run(os.Args)
 }
 
@@ -45,18 +58,7 @@ func addUser(cmd *cli.Cmd) {
 	email := cmd.StringArg("EMAIL", "", "Email of the new user")
 
 	cmd.Action = func() {
-		iniFile, err := ini.Load(*configPath)
-		if err != nil {
-			fmt.Print(err)
-			os.Exit(1)
-		}
-		config := charon.NewConfig(iniFile)
-
-		db, err := charon.NewDatabase(config)
-		if err != nil {
-			fmt.Print(err)
-			os.Exit(1)
-		}
+		db := loadDatabase(*configPath)
 
 		password := make([]byte, passwordLength)
 		for i := range password {
@@ -68,7 +70,7 @@ func addUser(cmd *cli.Cmd) {
 		}
 		sPassword := string(password)
 
-		err = db.AddUser(*username, *email, sPassword)
+		err := db.AddUser(context.Background(), *username, *email, sPassword)
 		if err != nil {
 			fmt.Print(err)
 			os.Exit(1)
@@ -79,3 +81,182 @@ func addUser(cmd *cli.Cmd) {
 		fmt.Printf("\tPassword: %s\n", sPassword)
 	}
 }
+
+func loadConfig(configPath string) *charon.Config {
+	iniFile, err := ini.Load(configPath)
+	if err != nil {
+		fmt.Print(err)
+		os.Exit(1)
+	}
+	config := charon.NewConfig(iniFile)
+	err = config.Validate()
+	if err != nil {
+		fmt.Print(err)
+		os.Exit(1)
+	}
+	return config
+}
+
+func loadDatabase(configPath string) charon.Store {
+	db, err := charon.NewDatabase(loadConfig(configPath))
+	if err != nil {
+		fmt.Print(err)
+		os.Exit(1)
+	}
+
+	return db
+}
+
+// openDatabase opens the database without migrating or checking its schema.
+func openDatabase(configPath string) charon.Store {
+	db, err := charon.OpenDatabase(loadConfig(configPath))
+	if err != nil {
+		fmt.Print(err)
+		os.Exit(1)
+	}
+
+	return db
+}
+
+func migrate(db charon.Store, version int) {
+	err := db.Migrate(context.Background(), version)
+	if err != nil {
+		fmt.Print(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Database schema is at version %d.\n", version)
+}
+
+func migrateUp(cmd *cli.Cmd) {
+	cmd.Spec = "[-c] [VERSION]"
+	configPath := cmd.StringOpt("c config", "charon.ini", "Path to the configuration file")
+	version := cmd.IntArg("VERSION", charon.LatestSchemaVersion, "Schema version to migrate up to")
+
+	cmd.Action = func() {
+		db := openDatabase(*configPath)
+		defer db.Close()
+
+		current, err := db.SchemaVersion(context.Background())
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+		if *version < current {
+			fmt.Printf("Database schema is already at version %d.\n", current)
+			os.Exit(1)
+		}
+
+		migrate(db, *version)
+	}
+}
+
+func migrateDown(cmd *cli.Cmd) {
+	cmd.Spec = "[-c] [VERSION]"
+	configPath := cmd.StringOpt("c config", "charon.ini", "Path to the configuration file")
+	version := cmd.IntArg("VERSION", -1, "Schema version to migrate down to")
+
+	cmd.Action = func() {
+		db := openDatabase(*configPath)
+		defer db.Close()
+
+		current, err := db.SchemaVersion(context.Background())
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+		if *version == -1 {
+			*version = current - 1
+		}
+		if *version < 0 || *version > current {
+			fmt.Printf("Can't migrate down from version %d to %d.\n", current, *version)
+			os.Exit(1)
+		}
+
+		migrate(db, *version)
+	}
+}
+
+func migrateStatus(cmd *cli.Cmd) {
+	cmd.Spec = "[-c]"
+	configPath := cmd.StringOpt("c config", "charon.ini", "Path to the configuration file")
+
+	cmd.Action = func() {
+		db := openDatabase(*configPath)
+		defer db.Close()
+
+		status, err := db.MigrationStatus(context.Background())
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+
+		for _, m := range status {
+			applied := "pending"
+			if m.AppliedAt != nil {
+				applied = "applied " + m.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-50s  %s\n", m.Version, m.Description, applied)
+		}
+	}
+}
+
+func addServer(cmd *cli.Cmd) {
+	cmd.Spec = "[-c] NAME NETWORKS..."
+	configPath := cmd.StringOpt("c config", "charon.ini", "Path to the configuration file")
+	name := cmd.StringArg("NAME", "", "Name of the new game server")
+	networks := cmd.StringsArg("NETWORKS", nil, "Networks or addresses the game server sends requests from")
+
+	cmd.Action = func() {
+		db := loadDatabase(*configPath)
+
+		server, err := db.AddServer(context.Background(), *name, *networks)
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+
+		fmt.Print("Server successfully added.\n")
+		fmt.Printf("\tID: %d\n", server.ID)
+		fmt.Printf("\tNetworks: %s\n", server.Networks)
+		fmt.Printf("\tSecret: %s\n", hex.EncodeToString(server.Secret))
+	}
+}
+
+func rotateServer(cmd *cli.Cmd) {
+	cmd.Spec = "[-c] ID"
+	configPath := cmd.StringOpt("c config", "charon.ini", "Path to the configuration file")
+	id := cmd.IntArg("ID", 0, "ID of the game server")
+
+	cmd.Action = func() {
+		db := loadDatabase(*configPath)
+
+		secret, err := db.RotateServerSecret(context.Background(), uint(*id))
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+
+		fmt.Print("Server secret successfully rotated.\n")
+		fmt.Printf("\tID: %d\n", *id)
+		fmt.Printf("\tSecret: %s\n", hex.EncodeToString(secret))
+	}
+}
+
+func revokeServer(cmd *cli.Cmd) {
+	cmd.Spec = "[-c] ID"
+	configPath := cmd.StringOpt("c config", "charon.ini", "Path to the configuration file")
+	id := cmd.IntArg("ID", 0, "ID of the game server")
+
+	cmd.Action = func() {
+		db := loadDatabase(*configPath)
+
+		err := db.RevokeServer(context.Background(), uint(*id))
+		if err != nil {
+			fmt.Print(err)
+			os.Exit(1)
+		}
+
+		fmt.Print("Server successfully revoked.\n")
+	}
+}
@@ -18,11 +18,55 @@
 
 package charon
 
-import "github.com/go-ini/ini"
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/go-ini/ini"
+)
 
 type Config struct {
+	Auth struct {
+		AllowInactive   bool
+		AllowUnverified bool
+		Listen          []string
+		ListenTCP       []string
+		MaxSessions     int
+		MaxTCPConns     int
+		QueueSize       int
+		Secret          string
+		ServerAuth      bool
+		SessionStore    string
+		SessionTTL      time.Duration
+		ShutdownTimeout time.Duration
+		TCPTimeout      time.Duration
+		Workers         int
+	}
 	Database struct {
-		Filename string
+		AutoMigrate bool
+		BusyTimeout time.Duration
+		Driver      string
+		DSN         string
+		Filename    string
+		JournalMode string
+	}
+	RateLimit struct {
+		SourceRate  float64
+		SourceBurst int
+		UserRate    float64
+		UserBurst   int
+	}
+	SRP struct {
+		Group        string
+		Groups       string
+		Hash         string
+		KDF          string
+		MinGroupSize int
+	}
+	Web struct {
+		Listen          []string
+		ShutdownTimeout time.Duration
 	}
 }
 
@@ -32,6 +76,60 @@ func NewConfig(iniFile *ini.File) (config *Config) {
 	}
 
 	config = new(Config)
+	config.Auth.AllowInactive = iniFile.Section("auth").Key("allowinactive").MustBool(false)
+	config.Auth.AllowUnverified = iniFile.Section("auth").Key("allowunverified").MustBool(false)
+	config.Auth.Listen = mustStrings(iniFile.Section("auth").Key("listen"), ":16666")
+	config.Auth.ListenTCP = mustStrings(iniFile.Section("auth").Key("listentcp"))
+	config.Auth.MaxSessions = iniFile.Section("auth").Key("maxsessions").MustInt(65536)
+	config.Auth.MaxTCPConns = iniFile.Section("auth").Key("maxtcpconns").MustInt(1024)
+	config.Auth.QueueSize = iniFile.Section("auth").Key("queuesize").MustInt(1024)
+	config.Auth.Secret = iniFile.Section("auth").Key("secret").String()
+	config.Auth.ServerAuth = iniFile.Section("auth").Key("serverauth").MustBool(false)
+	config.Auth.SessionStore = iniFile.Section("auth").Key("sessionstore").In("memory", []string{"memory", "database"})
+	config.Auth.SessionTTL = iniFile.Section("auth").Key("sessionttl").MustDuration(5 * time.Second)
+	config.Auth.ShutdownTimeout = iniFile.Section("auth").Key("shutdowntimeout").MustDuration(10 * time.Second)
+	config.Auth.TCPTimeout = iniFile.Section("auth").Key("tcptimeout").MustDuration(30 * time.Second)
+	config.Auth.Workers = iniFile.Section("auth").Key("workers").MustInt(runtime.NumCPU())
+	config.Database.AutoMigrate = iniFile.Section("database").Key("automigrate").MustBool(true)
+	config.Database.Driver = iniFile.Section("database").Key("driver").In("sqlite3", []string{"sqlite3", "postgres"})
+	config.Database.DSN = iniFile.Section("database").Key("dsn").String()
 	config.Database.Filename = iniFile.Section("database").Key("filename").MustString(":memory:")
+	config.Database.JournalMode = iniFile.Section("database").Key("journalmode").In("wal", []string{"wal", "delete", "truncate", "persist", "memory", "off"})
+	config.Database.BusyTimeout = iniFile.Section("database").Key("busytimeout").MustDuration(5 * time.Second)
+	config.RateLimit.SourceRate = iniFile.Section("ratelimit").Key("sourcerate").MustFloat64(20)
+	config.RateLimit.SourceBurst = iniFile.Section("ratelimit").Key("sourceburst").MustInt(100)
+	config.RateLimit.UserRate = iniFile.Section("ratelimit").Key("userrate").MustFloat64(0.2)
+	config.RateLimit.UserBurst = iniFile.Section("ratelimit").Key("userburst").MustInt(5)
+	config.SRP.Group = iniFile.Section("srp").Key("group").MustString(LegacySRPGroup)
+	config.SRP.Groups = iniFile.Section("srp").Key("groups").String()
+	config.SRP.Hash = iniFile.Section("srp").Key("hash").MustString(LegacySRPHash)
+	config.SRP.KDF = iniFile.Section("srp").Key("kdf").MustString(LegacyKDF)
+	config.SRP.MinGroupSize = iniFile.Section("srp").Key("mingroupsize").MustInt(2048)
+	config.Web.Listen = mustStrings(iniFile.Section("web").Key("listen"), ":8080")
+	config.Web.ShutdownTimeout = iniFile.Section("web").Key("shutdowntimeout").MustDuration(10 * time.Second)
 	return
 }
+
+// Validate checks that configured values are usable.
+func (config *Config) Validate() error {
+	if config.Auth.SessionTTL <= 0 {
+		return fmt.Errorf("auth sessionttl must be positive, not %s", config.Auth.SessionTTL)
+	}
+	if config.Auth.QueueSize < 0 {
+		return fmt.Errorf("auth queuesize must not be negative, not %d", config.Auth.QueueSize)
+	}
+	if config.Auth.MaxTCPConns < 0 {
+		return fmt.Errorf("auth maxtcpconns must not be negative, not %d", config.Auth.MaxTCPConns)
+	}
+	return nil
+}
+
+// mustStrings reads a comma-separated list, falling back to the default list
+// if the key is missing or empty.
+func mustStrings(key *ini.Key, defaultVal ...string) []string {
+	values := key.Strings(",")
+	if len(values) == 0 {
+		return defaultVal
+	}
+	return values
+}
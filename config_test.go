@@ -0,0 +1,87 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestConfigListen(t *testing.T) {
+	config := NewConfig(nil)
+	if !reflect.DeepEqual(config.Auth.Listen, []string{":16666"}) {
+		t.Errorf("Default auth listen addresses are %v", config.Auth.Listen)
+	}
+	if !reflect.DeepEqual(config.Web.Listen, []string{":8080"}) {
+		t.Errorf("Default web listen addresses are %v", config.Web.Listen)
+	}
+
+	iniFile, err := ini.Load([]byte(`
+[auth]
+listen=127.0.0.1:16666, [::1]:16666
+
+[web]
+listen=[::]:8080
+`))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	config = NewConfig(iniFile)
+	if !reflect.DeepEqual(config.Auth.Listen, []string{"127.0.0.1:16666", "[::1]:16666"}) {
+		t.Errorf("Auth listen addresses are %v", config.Auth.Listen)
+	}
+	if !reflect.DeepEqual(config.Web.Listen, []string{"[::]:8080"}) {
+		t.Errorf("Web listen addresses are %v", config.Web.Listen)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	err := NewConfig(nil).Validate()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+
+	for _, conf := range []string{
+		"[auth]\nsessionttl=0s\n",
+		"[auth]\nsessionttl=-5s\n",
+		"[auth]\nqueuesize=-1\n",
+		"[auth]\nmaxtcpconns=-1\n",
+	} {
+		iniFile, err := ini.Load([]byte(conf))
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		err = NewConfig(iniFile).Validate()
+		if err == nil {
+			t.Errorf("Config %q was not rejected", conf)
+		}
+	}
+
+	// An unbuffered queue is allowed.
+	iniFile, err := ini.Load([]byte("[auth]\nqueuesize=0\n"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = NewConfig(iniFile).Validate()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+}
@@ -19,87 +19,108 @@
 package charon
 
 import (
-	"crypto/sha256"
+	"context"
+	"crypto/rand"
+	"database/sql"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/AlexMax/charon/srp"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3" // Database driver
 )
 
 // Database is an instance of our database connection and all necessary state
 // used to manage said instance.
 type Database struct {
-	db    *sqlx.DB
-	mutex sync.Mutex
-}
-
-// Schema for sqlite3.
-const schema = `
-CREATE TABLE IF NOT EXISTS Users(
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	username VARCHAR(255),
-	email VARCHAR(255),
-	verifier BLOB,
-	salt BLOB,
-	access TEXT,
-	active TINYINT(1),
-	createdAt DATETIME NOT NULL,
-	updatedAt DATETIME NOT NULL
-);
-
-CREATE TABLE IF NOT EXISTS Profiles(
-	id INTEGER PRIMARY KEY AUTOINCREMENT,
-	clan VARCHAR(255),
-	clantag VARCHAR(255),
-	contactinfo VARCHAR(255),
-	country VARCHAR(255),
-	gravatar TEXT,
-	location VARCHAR(255),
-	message VARCHAR(255),
-	username VARCHAR(255),
-	visible TINYINT(1) DEFAULT 1,
-	visible_lastseen TINYINT(1) DEFAULT 1,
-	createdAt DATETIME NOT NULL,
-	updatedAt DATETIME NOT NULL,
-	UserId INTEGER
-);`
-
-var connectMutex sync.Mutex
-
-// NewDatabase creates a new Database instance.
+	db       *sqlx.DB
+	dialect  *dialect
+	srpGroup string // Group used for new verifiers
+	srpHash  string // Hash used for new verifiers
+	srpKDF   string // Key derivation used for new verifiers
+}
+
+// NewDatabase creates a new Database instance, migrating its schema to the
+// latest version if configured to.  Otherwise the schema must already be up
+// to date.
 func NewDatabase(config *Config) (database *Database, err error) {
-	// Create a database connection.
-	filename := config.Database.Filename
-	connectMutex.Lock()
-	db, err := sqlx.Connect("sqlite3", filename)
-	connectMutex.Unlock()
+	database, err = OpenDatabase(config)
 	if err != nil {
 		return
 	}
 
-	// Create the database schema.
-	_ = db.MustExec("PRAGMA foreign_keys = ON;")
-	_ = db.MustExec(schema)
+	ctx := context.Background()
+	if config.Database.AutoMigrate {
+		err = database.Migrate(ctx, LatestSchemaVersion)
+	} else {
+		var version int
+		version, err = database.SchemaVersion(ctx)
+		if err == nil && version != LatestSchemaVersion {
+			err = fmt.Errorf("database schema is at version %d instead of %d, it must be migrated", version, LatestSchemaVersion)
+		}
+	}
+	if err != nil {
+		database.Close()
+		database = nil
+	}
+	return
+}
+
+// OpenDatabase creates a new Database instance without touching its schema.
+func OpenDatabase(config *Config) (database *Database, err error) {
+	// Load custom groups, and ensure new verifiers can be created.
+	if config.SRP.Groups != "" {
+		err = LoadSRPGroups(config.SRP.Groups)
+		if err != nil {
+			return
+		}
+	}
+	err = checkSRPGroup(config.SRP.Group, config.SRP.MinGroupSize)
+	if err != nil {
+		return
+	}
+	_, err = NewSRP(config.SRP.Group, config.SRP.Hash, config.SRP.KDF)
+	if err != nil {
+		return
+	}
+
+	// Create a database connection.
+	d, ok := dialects[config.Database.Driver]
+	if !ok {
+		err = fmt.Errorf("unknown database driver \"%s\"", config.Database.Driver)
+		return
+	}
+	db, err := d.connect(config)
+	if err != nil {
+		return
+	}
 
 	database = new(Database)
 	database.db = db
+	database.dialect = d
+	database.srpGroup = config.SRP.Group
+	database.srpHash = config.SRP.Hash
+	database.srpKDF = config.SRP.KDF
 	return
 }
 
+// Close closes the database connection.
+func (database *Database) Close() error {
+	return database.db.Close()
+}
+
 // Import executes a file containing SQL statements on the loaded database.
-func (database *Database) Import(paths ...string) (err error) {
+func (database *Database) Import(ctx context.Context, paths ...string) (err error) {
 	for _, path := range paths {
 		data, err := ioutil.ReadFile(path)
 		if err != nil {
 			return err
 		}
 
-		_, err = database.db.Exec(string(data))
+		_, err = database.db.ExecContext(ctx, string(data))
 		if err != nil {
 			return err
 		}
@@ -115,6 +136,9 @@ type User struct {
 	Email     string
 	Verifier  []byte
 	Salt      []byte
+	SRPGroup  string `db:"srpGroup"`
+	SRPHash   string `db:"srpHash"`
+	KDF       string `db:"kdf"`
 	Access    string
 	Active    bool
 	CreatedAt time.Time `db:"createdAt"`
@@ -131,16 +155,14 @@ const (
 )
 
 // AddUser adds a new user.
-func (database *Database) AddUser(username string, email string, password string) (err error) {
+func (database *Database) AddUser(ctx context.Context, username string, email string, password string) (err error) {
 	// Username and email are forced lowercase
 	username = strings.ToLower(username)
 	email = strings.ToLower(email)
 
 	// Must be unique
 	var count int
-	database.mutex.Lock()
-	err = database.db.Get(&count, "SELECT COUNT(*) FROM Users WHERE Username = ?", username)
-	database.mutex.Unlock()
+	err = database.db.GetContext(ctx, &count, database.db.Rebind("SELECT COUNT(*) FROM Users WHERE username = ?"), username)
 	if err != nil {
 		return err
 	}
@@ -148,7 +170,7 @@ func (database *Database) AddUser(username string, email string, password string
 		return errors.New("charon: username is not unique")
 	}
 
-	srp, err := srp.NewSRP("rfc5054.2048", sha256.New, nil)
+	srpo, err := NewSRP(database.srpGroup, database.srpHash, database.srpKDF)
 	if err != nil {
 		return err
 	}
@@ -156,45 +178,83 @@ func (database *Database) AddUser(username string, email string, password string
 	user := new(User)
 	user.Username = username
 	user.Email = email
+	user.SRPGroup = database.srpGroup
+	user.SRPHash = database.srpHash
+	user.KDF = database.srpKDF
 	user.Access = UserAccessUnverified
 	user.Active = false
 	user.CreatedAt = time.Now()
 	user.UpdatedAt = time.Now()
 
-	user.Salt, user.Verifier, err = srp.ComputeVerifier([]byte(username), []byte(password))
+	user.Salt, user.Verifier, err = srpo.ComputeVerifier([]byte(username), []byte(password))
 	if err != nil {
 		return err
 	}
 
-	database.mutex.Lock()
-	_, err = database.db.NamedExec("INSERT INTO Users (Username, Email, Verifier, Salt, Access, Active, createdAt, updatedAt) VALUES (:username, :email, :verifier, :salt, :access, :active, :createdAt, :updatedAt)", user)
-	database.mutex.Unlock()
+	// Every user starts out with a blank profile.
+	tx, err := database.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	query, args, err := sqlx.Named(`INSERT INTO Users (username, email, verifier, salt, "srpGroup", "srpHash", kdf, access, active, "createdAt", "updatedAt") VALUES (:username, :email, :verifier, :salt, :srpGroup, :srpHash, :kdf, :access, :active, :createdAt, :updatedAt) RETURNING id`, user)
+	if err != nil {
+		return
+	}
+	err = tx.GetContext(ctx, &user.ID, tx.Rebind(query), args...)
+	if err != nil {
+		return
+	}
+
+	err = insertProfile(ctx, tx, &Profile{UserID: user.ID, Visible: true, VisibleLastseen: true})
+	if err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// UpdateUser saves changes to an existing user's email, access level and
+// active flag.
+func (database *Database) UpdateUser(ctx context.Context, user *User) (err error) {
+	user.Email = strings.ToLower(user.Email)
+	user.UpdatedAt = time.Now()
+
+	_, err = database.db.NamedExecContext(ctx, `UPDATE Users SET email = :email, access = :access, active = :active, "updatedAt" = :updatedAt WHERE id = :id`, user)
 	return
 }
 
 // FindUser tries to find a specific user by name or email address.
-func (database *Database) FindUser(username string) (user *User, err error) {
+func (database *Database) FindUser(ctx context.Context, username string) (user *User, err error) {
 	// Username is forced lowercase
 	username = strings.ToLower(username)
 
 	user = &User{}
-	database.mutex.Lock()
-	err = database.db.Get(user, "SELECT * FROM users WHERE username = $1 OR email = $1", strings.ToLower(username))
-	database.mutex.Unlock()
+	err = database.db.GetContext(ctx, user, database.db.Rebind("SELECT * FROM Users WHERE username = ? OR email = ?"), username, username)
+	return
+}
+
+// FindUserByName tries to find a specific user by name only.  Game servers
+// look users up this way, so that an email address can't be used to learn
+// a user's name.
+func (database *Database) FindUserByName(ctx context.Context, username string) (user *User, err error) {
+	user = &User{}
+	err = database.db.GetContext(ctx, user, database.db.Rebind("SELECT * FROM Users WHERE username = ?"), strings.ToLower(username))
 	return
 }
 
 // LoginUser tries to log a user in with the passed username and password.
-func (database *Database) LoginUser(username string, password string) (user *User, err error) {
+func (database *Database) LoginUser(ctx context.Context, username string, password string) (user *User, err error) {
 	// Username is forced lowercase
 	username = strings.ToLower(username)
 
-	user, err = database.FindUser(username)
+	user, err = database.FindUser(ctx, username)
 	if err != nil {
 		return
 	}
 
-	srpo, err := srp.NewSRP("rfc5054.2048", sha256.New, nil)
+	srpo, err := NewSRP(user.SRPGroup, user.SRPHash, user.KDF)
 	if err != nil {
 		return
 	}
@@ -218,20 +278,380 @@ func (database *Database) LoginUser(username string, password string) (user *Use
 		return
 	}
 
+	// Now that we know the password, move the verifier over to the
+	// configured key derivation if it is stronger.  Users never go back to
+	// a weaker one, as that would make their verifier easier to crack.
+	if strongerKDF(database.srpKDF, user.KDF) {
+		err = database.upgradeUserKDF(ctx, user, password)
+		if err != nil {
+			log.Printf("[ERROR] Could not upgrade verifier for %s: %s", user.Username, err.Error())
+			err = nil
+		}
+	}
+
+	return
+}
+
+// upgradeUserKDF replaces a user's verifier with one derived using the
+// configured key derivation.  The user's group and hash are kept.
+func (database *Database) upgradeUserKDF(ctx context.Context, user *User, password string) (err error) {
+	srpo, err := NewSRP(user.SRPGroup, user.SRPHash, database.srpKDF)
+	if err != nil {
+		return
+	}
+
+	upgraded := *user
+	upgraded.KDF = database.srpKDF
+	upgraded.UpdatedAt = time.Now()
+	upgraded.Salt, upgraded.Verifier, err = srpo.ComputeVerifier([]byte(user.Username), []byte(password))
+	if err != nil {
+		return
+	}
+
+	_, err = database.db.NamedExecContext(ctx, `UPDATE Users SET verifier = :verifier, salt = :salt, kdf = :kdf, "updatedAt" = :updatedAt WHERE id = :id`, &upgraded)
+	if err != nil {
+		return
+	}
+
+	*user = upgraded
 	return
 }
 
-// Profile is representation of the `profile` table in the database.
+// Profile is a representation of the `Profiles` table in the database.  Every
+// user has exactly one profile.
 type Profile struct {
-	ID                 uint
-	User_id            uint
-	Clan               string
-	Contactinfo        string
-	Country            string
-	Gravatar           string
-	Location           string
-	Message            string
-	Username           string
-	Visible            bool
-	Visible_lastplayed bool
+	ID              uint
+	UserID          uint `db:"UserId"`
+	Clan            string
+	Clantag         string
+	Contactinfo     string
+	Country         string
+	Gravatar        string
+	Location        string
+	Message         string
+	Username        string
+	Visible         bool
+	VisibleLastseen bool      `db:"visible_lastseen"`
+	CreatedAt       time.Time `db:"createdAt"`
+	UpdatedAt       time.Time `db:"updatedAt"`
+}
+
+// Profile columns, most of which can be NULL.
+const profileColumns = `id, "UserId",
+	COALESCE(clan, '') AS clan,
+	COALESCE(clantag, '') AS clantag,
+	COALESCE(contactinfo, '') AS contactinfo,
+	COALESCE(country, '') AS country,
+	COALESCE(gravatar, '') AS gravatar,
+	COALESCE(location, '') AS location,
+	COALESCE(message, '') AS message,
+	COALESCE(username, '') AS username,
+	COALESCE(visible, TRUE) AS visible,
+	COALESCE(visible_lastseen, TRUE) AS visible_lastseen,
+	"createdAt", "updatedAt"`
+
+// FindProfile tries to find the profile belonging to a specific user.
+func (database *Database) FindProfile(ctx context.Context, userID uint) (profile *Profile, err error) {
+	profile = &Profile{}
+	err = database.db.GetContext(ctx, profile, database.db.Rebind("SELECT "+profileColumns+` FROM Profiles WHERE "UserId" = ?`), userID)
+	return
+}
+
+// AddProfile adds a profile for a user that doesn't have one.
+func (database *Database) AddProfile(ctx context.Context, profile *Profile) error {
+	return insertProfile(ctx, database.db, profile)
+}
+
+// insertProfile inserts a profile, either on its own or as part of a
+// transaction.
+func insertProfile(ctx context.Context, ext sqlx.ExtContext, profile *Profile) (err error) {
+	profile.CreatedAt = time.Now()
+	profile.UpdatedAt = profile.CreatedAt
+
+	query, args, err := sqlx.Named(`INSERT INTO Profiles ("UserId", clan, clantag, contactinfo, country, gravatar, location, message, username, visible, visible_lastseen, "createdAt", "updatedAt") VALUES (:UserId, :clan, :clantag, :contactinfo, :country, :gravatar, :location, :message, :username, :visible, :visible_lastseen, :createdAt, :updatedAt) RETURNING id`, profile)
+	if err != nil {
+		return
+	}
+
+	return sqlx.GetContext(ctx, ext, &profile.ID, ext.Rebind(query), args...)
+}
+
+// UpdateProfile saves changes to a user's profile.
+func (database *Database) UpdateProfile(ctx context.Context, profile *Profile) (err error) {
+	profile.UpdatedAt = time.Now()
+
+	result, err := database.db.NamedExecContext(ctx, `UPDATE Profiles SET clan = :clan, clantag = :clantag, contactinfo = :contactinfo, country = :country, gravatar = :gravatar, location = :location, message = :message, username = :username, visible = :visible, visible_lastseen = :visible_lastseen, "updatedAt" = :updatedAt WHERE "UserId" = :UserId`, profile)
+	if err != nil {
+		return
+	}
+
+	return rowAffected(result)
+}
+
+// ListProfiles returns up to limit profiles in the order they were created,
+// skipping the first offset profiles.
+func (database *Database) ListProfiles(ctx context.Context, offset int, limit int) (profiles []Profile, err error) {
+	err = database.db.SelectContext(ctx, &profiles, database.db.Rebind("SELECT "+profileColumns+" FROM Profiles ORDER BY id LIMIT ? OFFSET ?"), limit, offset)
+	return
+}
+
+// Server is a representation of the `Servers` table in the database.  Each
+// row is a game server that is trusted to make requests to the auth server.
+type Server struct {
+	ID        uint
+	Name      string
+	Secret    []byte
+	Networks  string // Comma-separated list of CIDR networks
+	Active    bool
+	CreatedAt time.Time `db:"createdAt"`
+	UpdatedAt time.Time `db:"updatedAt"`
+}
+
+// ServerSecretLength is the size of a generated server secret in bytes.
+const ServerSecretLength = 32
+
+// Allows returns true if the passed IP address is inside one of the server's
+// allowed networks.
+func (server *Server) Allows(ip net.IP) bool {
+	for _, network := range strings.Split(server.Networks, ",") {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(network))
+		if err != nil {
+			continue
+		}
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseNetworks validates a list of networks, turning bare IP addresses into
+// single-address networks.
+func parseNetworks(networks []string) (string, error) {
+	var cidrs []string
+	for _, network := range networks {
+		if ip := net.ParseIP(network); ip != nil {
+			if ip.To4() != nil {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return "", err
+		}
+		cidrs = append(cidrs, ipnet.String())
+	}
+
+	if len(cidrs) == 0 {
+		return "", errors.New("charon: server needs at least one network")
+	}
+
+	return strings.Join(cidrs, ","), nil
+}
+
+// newServerSecret generates a random server secret.
+func newServerSecret() (secret []byte, err error) {
+	secret = make([]byte, ServerSecretLength)
+	_, err = rand.Read(secret)
+	return
+}
+
+// AddServer registers a new game server that is allowed to make requests from
+// the passed networks.  The returned server contains the generated secret.
+func (database *Database) AddServer(ctx context.Context, name string, networks []string) (server *Server, err error) {
+	server = new(Server)
+	server.Name = name
+	server.Networks, err = parseNetworks(networks)
+	if err != nil {
+		return
+	}
+	server.Secret, err = newServerSecret()
+	if err != nil {
+		return
+	}
+	server.Active = true
+	server.CreatedAt = time.Now()
+	server.UpdatedAt = time.Now()
+
+	// PostgreSQL has no LastInsertId, but both databases support RETURNING.
+	query, args, err := sqlx.Named(`INSERT INTO Servers (name, secret, networks, active, "createdAt", "updatedAt") VALUES (:name, :secret, :networks, :active, :createdAt, :updatedAt) RETURNING id`, server)
+	if err != nil {
+		return
+	}
+
+	err = database.db.GetContext(ctx, &server.ID, database.db.Rebind(query), args...)
+	return
+}
+
+// FindServer tries to find a specific game server by ID.
+func (database *Database) FindServer(ctx context.Context, id uint) (server *Server, err error) {
+	server = &Server{}
+	err = database.db.GetContext(ctx, server, database.db.Rebind("SELECT * FROM Servers WHERE id = ?"), id)
+	return
+}
+
+// RotateServerSecret replaces the secret of an existing game server, returning
+// the new secret.
+func (database *Database) RotateServerSecret(ctx context.Context, id uint) (secret []byte, err error) {
+	secret, err = newServerSecret()
+	if err != nil {
+		return
+	}
+
+	result, err := database.db.ExecContext(ctx, database.db.Rebind(`UPDATE Servers SET secret = ?, "updatedAt" = ? WHERE id = ? AND active = ?`), secret, time.Now(), id, true)
+	if err != nil {
+		return
+	}
+
+	err = rowAffected(result)
+	return
+}
+
+// RevokeServer stops a game server from making any further requests.
+func (database *Database) RevokeServer(ctx context.Context, id uint) (err error) {
+	result, err := database.db.ExecContext(ctx, database.db.Rebind(`UPDATE Servers SET active = ?, "updatedAt" = ? WHERE id = ? AND active = ?`), false, time.Now(), id, true)
+	if err != nil {
+		return
+	}
+
+	return rowAffected(result)
+}
+
+// SessionRecord is a representation of the `Sessions` table in the database.
+type SessionRecord struct {
+	ID       uint32
+	Network  string
+	Address  string
+	State    SessionState
+	SRP      []byte
+	UserID   uint `db:"userId"`
+	Username string
+	Access   string
+	SRPGroup string `db:"srpGroup"`
+	SRPHash  string `db:"srpHash"`
+	Version  uint8
+	Decoy    bool
+	Unsafe   bool
+	Expires  int64 // Nanoseconds since the Unix epoch
+
+	EphemeralRequest  []byte `db:"ephemeralRequest"`
+	EphemeralResponse []byte `db:"ephemeralResponse"`
+	ProofRequest      []byte `db:"proofRequest"`
+	ProofResponse     []byte `db:"proofResponse"`
+}
+
+// AddSession stores a new session, replacing an expired session with the
+// same ID.  It returns ErrSessionExists if the ID is taken, or
+// ErrSessionStoreFull if max unexpired sessions already exist.  A max of 0
+// places no limit on the number of sessions.
+func (database *Database) AddSession(ctx context.Context, record *SessionRecord, now time.Time, max int) (err error) {
+
+	tx, err := database.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, tx.Rebind("DELETE FROM Sessions WHERE id = ? AND expires <= ?"), record.ID, now.UnixNano())
+	if err != nil {
+		return
+	}
+
+	var count int
+	err = tx.GetContext(ctx, &count, tx.Rebind("SELECT COUNT(*) FROM Sessions WHERE id = ?"), record.ID)
+	if err != nil {
+		return
+	}
+	if count > 0 {
+		return ErrSessionExists
+	}
+
+	if max > 0 {
+		err = tx.GetContext(ctx, &count, tx.Rebind("SELECT COUNT(*) FROM Sessions WHERE expires > ?"), now.UnixNano())
+		if err != nil {
+			return
+		}
+		if count >= max {
+			return ErrSessionStoreFull
+		}
+	}
+
+	_, err = tx.NamedExecContext(ctx, `INSERT INTO Sessions (id, network, address, state, srp, "userId", username, access, "srpGroup", "srpHash", version, decoy, unsafe, expires) VALUES (:id, :network, :address, :state, :srp, :userId, :username, :access, :srpGroup, :srpHash, :version, :decoy, :unsafe, :expires)`, record)
+	if err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+// FindSession tries to find a session that hasn't expired.
+func (database *Database) FindSession(ctx context.Context, id uint32, now time.Time) (record *SessionRecord, err error) {
+	record = &SessionRecord{}
+	err = database.db.GetContext(ctx, record, database.db.Rebind("SELECT * FROM Sessions WHERE id = ? AND expires > ?"), id, now.UnixNano())
+	return
+}
+
+// UpdateSession saves the state, SRP state and replies of a session that
+// hasn't expired.  It returns ErrSessionConflict if the session is no longer
+// in prevState.
+func (database *Database) UpdateSession(ctx context.Context, record *SessionRecord, prevState SessionState, now time.Time) (err error) {
+	result, err := database.db.ExecContext(ctx, database.db.Rebind(`UPDATE Sessions SET state = ?, srp = ?, "ephemeralRequest" = ?, "ephemeralResponse" = ?, "proofRequest" = ?, "proofResponse" = ? WHERE id = ? AND expires > ? AND state = ?`),
+		record.State, record.SRP,
+		record.EphemeralRequest, record.EphemeralResponse,
+		record.ProofRequest, record.ProofResponse,
+		record.ID, now.UnixNano(), prevState)
+	if err != nil {
+		return
+	}
+
+	err = rowAffected(result)
+	if err != sql.ErrNoRows {
+		return
+	}
+
+	// Tell a session that was changed apart from one that is gone.
+	var count int
+	err = database.db.GetContext(ctx, &count, database.db.Rebind("SELECT COUNT(*) FROM Sessions WHERE id = ? AND expires > ?"), record.ID, now.UnixNano())
+	if err != nil {
+		return
+	}
+	if count > 0 {
+		return ErrSessionConflict
+	}
+	return sql.ErrNoRows
+}
+
+// DeleteSession removes a session, if it exists.
+func (database *Database) DeleteSession(ctx context.Context, id uint32) (err error) {
+	_, err = database.db.ExecContext(ctx, database.db.Rebind("DELETE FROM Sessions WHERE id = ?"), id)
+	return
+}
+
+// DeleteExpiredSessions removes every session that has expired.
+func (database *Database) DeleteExpiredSessions(ctx context.Context, now time.Time) (err error) {
+	_, err = database.db.ExecContext(ctx, database.db.Rebind("DELETE FROM Sessions WHERE expires <= ?"), now.UnixNano())
+	return
+}
+
+// PendingSessions counts the sessions that have neither expired nor been
+// completed.
+func (database *Database) PendingSessions(ctx context.Context, now time.Time) (count int, err error) {
+	err = database.db.GetContext(ctx, &count, database.db.Rebind("SELECT COUNT(*) FROM Sessions WHERE expires > ? AND state != ?"), now.UnixNano(), SessionCompleted)
+	return
+}
+
+// rowAffected ensures that a statement changed a row.
+func rowAffected(result sql.Result) (err error) {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return
 }
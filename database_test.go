@@ -18,7 +18,26 @@
 
 package charon
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDatabase opens a database that is closed once the test is over.
+func newTestDatabase(t testing.TB, config *Config) *Database {
+	database, err := NewDatabase(config)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	t.Cleanup(func() {
+		database.Close()
+	})
+	return database
+}
 
 func TestNewDatabase(t *testing.T) {
 	_, err := NewDatabase(NewConfig(nil))
@@ -33,7 +52,7 @@ func TestAddUser(t *testing.T) {
 		t.Errorf("%s", err.Error())
 	}
 
-	err = database.AddUser("TestUser", "testuser@example.com", "VsGnJghDUW6C")
+	err = database.AddUser(context.Background(), "TestUser", "testuser@example.com", "VsGnJghDUW6C")
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
@@ -45,12 +64,12 @@ func TestAddUserErrors(t *testing.T) {
 		t.Errorf("%s", err.Error())
 	}
 
-	err = database.Import("fixture/user.sql")
+	err = database.Import(context.Background(), "fixture/user.sql")
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
 
-	err = database.AddUser("TestUser", "testuser@example.com", "VsGnJghDUW6C")
+	err = database.AddUser(context.Background(), "TestUser", "testuser@example.com", "VsGnJghDUW6C")
 	if err == nil {
 		t.Errorf("charon: user added despite uniqueness constraint")
 	}
@@ -62,12 +81,12 @@ func TestFindUser(t *testing.T) {
 		t.Errorf("%s", err.Error())
 	}
 
-	err = database.Import("fixture/user.sql")
+	err = database.Import(context.Background(), "fixture/user.sql")
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
 
-	_, err = database.FindUser("TestUser")
+	_, err = database.FindUser(context.Background(), "TestUser")
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
@@ -79,13 +98,315 @@ func TestLoginUser(t *testing.T) {
 		t.Errorf("%s", err.Error())
 	}
 
-	database.Import("fixture/user.sql")
+	database.Import(context.Background(), "fixture/user.sql")
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+
+	_, err = database.LoginUser(context.Background(), "TestUser", "VsGnJghDUW6C")
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+}
+
+func TestAddUserGroup(t *testing.T) {
+	config := NewConfig(nil)
+	config.SRP.Group = "rfc5054.3072"
+	config.SRP.Hash = "sha512"
+	database, err := NewDatabase(config)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// Existing users keep their group and hash.
+	err = database.Import(context.Background(), "fixture/user.sql")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	user, err := database.LoginUser(context.Background(), "testuser", "VsGnJghDUW6C")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if user.SRPGroup != LegacySRPGroup || user.SRPHash != LegacySRPHash {
+		t.Errorf("Existing user uses %s/%s", user.SRPGroup, user.SRPHash)
+	}
+
+	// New users get the configured group and hash.
+	err = database.AddUser(context.Background(), "username", "charontest@mailinator.com", "password")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	user, err = database.LoginUser(context.Background(), "username", "password")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if user.SRPGroup != "rfc5054.3072" || user.SRPHash != "sha512" {
+		t.Errorf("New user uses %s/%s", user.SRPGroup, user.SRPHash)
+	}
+	_, err = database.LoginUser(context.Background(), "username", "wrong")
+	if err == nil {
+		t.Errorf("User logged in with the wrong password")
+	}
+}
+
+func TestLoginUserUpgradeKDF(t *testing.T) {
+	config := NewConfig(nil)
+	config.SRP.KDF = "argon2id:t=1,m=64,p=1"
+	database, err := NewDatabase(config)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = database.Import(context.Background(), "fixture/user.sql")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// A wrong password leaves the old verifier alone.
+	_, err = database.LoginUser(context.Background(), "testuser", "wrong")
+	if err == nil {
+		t.Errorf("User logged in with the wrong password")
+	}
+	user, err := database.FindUser(context.Background(), "testuser")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if user.KDF != LegacyKDF {
+		t.Errorf("Failed login changed KDF to %s", user.KDF)
+	}
+
+	// A successful login upgrades it.
+	_, err = database.LoginUser(context.Background(), "testuser", "VsGnJghDUW6C")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	user, err = database.FindUser(context.Background(), "testuser")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if user.KDF != config.SRP.KDF {
+		t.Errorf("Verifier uses %s instead of %s", user.KDF, config.SRP.KDF)
+	}
+	if user.SRPGroup != LegacySRPGroup || user.SRPHash != LegacySRPHash {
+		t.Errorf("Upgraded user uses %s/%s", user.SRPGroup, user.SRPHash)
+	}
+
+	// The upgraded verifier still works.
+	_, err = database.LoginUser(context.Background(), "testuser", "VsGnJghDUW6C")
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	_, err = database.LoginUser(context.Background(), "testuser", "wrong")
+	if err == nil {
+		t.Errorf("User logged in with the wrong password")
+	}
+
+	// Going back to a weaker key derivation leaves it alone.
+	database.srpKDF = LegacyKDF
+	_, err = database.LoginUser(context.Background(), "testuser", "VsGnJghDUW6C")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	user, err = database.FindUser(context.Background(), "testuser")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if user.KDF != config.SRP.KDF {
+		t.Errorf("Verifier was moved back to %s", user.KDF)
+	}
+}
+
+func TestNewDatabaseGroupErrors(t *testing.T) {
+	config := NewConfig(nil)
+	config.SRP.Hash = "md5"
+	_, err := NewDatabase(config)
+	if err == nil {
+		t.Errorf("Database was created with an invalid hash")
+	}
+
+	config = NewConfig(nil)
+	config.SRP.Group = "rfc5054.1000"
+	_, err = NewDatabase(config)
+	if err == nil {
+		t.Errorf("Database was created with an invalid group")
+	}
+
+	config = NewConfig(nil)
+	config.SRP.Group = "rfc5054.1024"
+	_, err = NewDatabase(config)
+	if err == nil {
+		t.Errorf("Database was created with a group below the minimum size")
+	}
+
+	config = NewConfig(nil)
+	config.SRP.Groups = filepath.Join(t.TempDir(), "missing.ini")
+	_, err = NewDatabase(config)
+	if err == nil {
+		t.Errorf("Database was created with a missing groups file")
+	}
+
+	config = NewConfig(nil)
+	config.SRP.KDF = "scrypt:N=1000,r=8,p=1"
+	_, err = NewDatabase(config)
+	if err == nil {
+		t.Errorf("Database was created with an invalid KDF")
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	database, err := NewDatabase(NewConfig(nil))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+
+	err = database.Import(context.Background(), "fixture/user.sql")
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+
+	user, err := database.FindUser(context.Background(), "TestUser")
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+
+	user.Access = UserAccessOp
+	user.Active = true
+	err = database.UpdateUser(context.Background(), user)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+
+	user, err = database.FindUser(context.Background(), "TestUser")
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	if user.Access != UserAccessOp {
+		t.Errorf("Access is %v instead of %v", user.Access, UserAccessOp)
+	}
+	if user.Active != true {
+		t.Errorf("User is not active")
+	}
+}
+
+func TestAddServer(t *testing.T) {
+	database, err := NewDatabase(NewConfig(nil))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+
+	server, err := database.AddServer(context.Background(), "Test Server", []string{"192.0.2.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(server.Secret) != ServerSecretLength {
+		t.Errorf("Secret is %d bytes instead of %d", len(server.Secret), ServerSecretLength)
+	}
+
+	found, err := database.FindServer(context.Background(), server.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if !found.Allows(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Server does not allow 192.0.2.1")
+	}
+	if !found.Allows(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Server does not allow 2001:db8::1")
+	}
+	if found.Allows(net.ParseIP("192.0.2.2")) {
+		t.Errorf("Server allows 192.0.2.2")
+	}
+}
+
+func TestAddServerErrors(t *testing.T) {
+	database, err := NewDatabase(NewConfig(nil))
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
 
-	_, err = database.LoginUser("TestUser", "VsGnJghDUW6C")
+	_, err = database.AddServer(context.Background(), "Test Server", []string{})
+	if err == nil {
+		t.Errorf("charon: server added without any networks")
+	}
+
+	_, err = database.AddServer(context.Background(), "Test Server", []string{"not a network"})
+	if err == nil {
+		t.Errorf("charon: server added with an invalid network")
+	}
+}
+
+func TestRotateRevokeServer(t *testing.T) {
+	database, err := NewDatabase(NewConfig(nil))
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
+
+	server, err := database.AddServer(context.Background(), "Test Server", []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	secret, err := database.RotateServerSecret(context.Background(), server.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if bytes.Equal(secret, server.Secret) {
+		t.Errorf("Secret was not rotated")
+	}
+
+	err = database.RevokeServer(context.Background(), server.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	found, err := database.FindServer(context.Background(), server.ID)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if found.Active {
+		t.Errorf("Server is still active")
+	}
+
+	_, err = database.RotateServerSecret(context.Background(), server.ID)
+	if err == nil {
+		t.Errorf("charon: revoked server secret was rotated")
+	}
+}
+
+func TestOpenDatabaseSQLitePragmas(t *testing.T) {
+	config := NewConfig(nil)
+	config.Database.Filename = filepath.Join(t.TempDir(), "charon.db")
+	config.Database.BusyTimeout = 1234 * time.Millisecond
+
+	database, err := OpenDatabase(config)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer database.Close()
+
+	// Hold on to several connections, so each of them is checked.
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		conn, err := database.db.Connx(ctx)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		defer conn.Close()
+
+		var journalMode string
+		var busyTimeout, foreignKeys int
+		err = conn.GetContext(ctx, &journalMode, "PRAGMA journal_mode")
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		err = conn.GetContext(ctx, &busyTimeout, "PRAGMA busy_timeout")
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		err = conn.GetContext(ctx, &foreignKeys, "PRAGMA foreign_keys")
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if journalMode != "wal" || busyTimeout != 1234 || foreignKeys != 1 {
+			t.Errorf("Connection %d has journal_mode=%s, busy_timeout=%d, foreign_keys=%d", i, journalMode, busyTimeout, foreignKeys)
+		}
+	}
 }
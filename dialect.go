@@ -0,0 +1,64 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq" // Database driver
+)
+
+// dialect is what differs between the databases we support.  Schema and
+// queries are written for SQLite, with placeholders rebound by sqlx and
+// mixed-case columns quoted so that PostgreSQL keeps their case.
+type dialect struct {
+	driver  string
+	connect func(config *Config) (*sqlx.DB, error)
+	types   *strings.Replacer // Turns SQLite column types into our own
+	columns string            // Lists the columns of a table
+}
+
+// dialects by driver name.  SQLite needs cgo, so it registers itself in
+// sqlite3.go.
+var dialects = map[string]*dialect{
+	"postgres": {
+		driver: "postgres",
+		connect: func(config *Config) (*sqlx.DB, error) {
+			return sqlx.Connect("postgres", config.Database.DSN)
+		},
+		// Longer types come first, so they are replaced before their
+		// prefixes are.
+		types: strings.NewReplacer(
+			"INTEGER PRIMARY KEY AUTOINCREMENT", "SERIAL PRIMARY KEY",
+			"INTEGER PRIMARY KEY", "BIGINT PRIMARY KEY",
+			"TINYINT(1) DEFAULT 1", "BOOLEAN DEFAULT TRUE",
+			"TINYINT(1)", "BOOLEAN",
+			"TINYINT", "SMALLINT",
+			"BLOB", "BYTEA",
+			"DATETIME", "TIMESTAMP WITH TIME ZONE",
+		),
+		columns: "SELECT column_name AS name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = LOWER(?)",
+	},
+}
+
+// schema translates a schema statement written for SQLite.
+func (d *dialect) schema(statement string) string {
+	return d.types.Replace(statement)
+}
@@ -1,5 +1,5 @@
 -- Username: TestUser
 -- Password: VsGnJghDUW6C
 BEGIN TRANSACTION;
-INSERT INTO "Users" VALUES(1,'testuser','testuser@example.com',X'36DBCB56F44203CBE6F4B828AD061BDAE946BC54E217855047443ED403D6F85548567C9D4D13D4B8FE1097FB641769DCE55A67B8C533E1B0F8C8BA158ACAAC26DF3CE97CC42C66CD3FF1A8B641CB68E6B5A28C2256F8A14EC32D9B147BE5042ACEAA141B6D4BACD4DD6270C077B8789CAE16E69CB300AE814FB3EFF1BA4A698193F344B6B244F387F311FD3DA755A4B53786E10ACDB0B46B1E5E8335856E7EB039D5379A4205E04325B3D1E3E64F6C284E13029034235233CB37C66B3B06A58C1AD4E9B5C6D0487947BA6A69CB5E9832422B3E90106E5281A251C199A0ADCFB22DC76E0632126B34E544AB9A006207C27B2523DD12577DE5DC7C0B18203917AA',X'5146134A9492DCF64A64B232B536C5A6773F995B','UNVERIFIED',0,'2016-03-16 22:50:33.1694004-04:00','2016-03-16 22:50:33.1694004-04:00');
+INSERT INTO "Users" (id, username, email, verifier, salt, access, active, createdAt, updatedAt) VALUES(1,'testuser','testuser@example.com',X'36DBCB56F44203CBE6F4B828AD061BDAE946BC54E217855047443ED403D6F85548567C9D4D13D4B8FE1097FB641769DCE55A67B8C533E1B0F8C8BA158ACAAC26DF3CE97CC42C66CD3FF1A8B641CB68E6B5A28C2256F8A14EC32D9B147BE5042ACEAA141B6D4BACD4DD6270C077B8789CAE16E69CB300AE814FB3EFF1BA4A698193F344B6B244F387F311FD3DA755A4B53786E10ACDB0B46B1E5E8335856E7EB039D5379A4205E04325B3D1E3E64F6C284E13029034235233CB37C66B3B06A58C1AD4E9B5C6D0487947BA6A69CB5E9832422B3E90106E5281A251C199A0ADCFB22DC76E0632126B34E544AB9A006207C27B2523DD12577DE5DC7C0B18203917AA',X'5146134A9492DCF64A64B232B536C5A6773F995B','UNVERIFIED',0,'2016-03-16 22:50:33.1694004-04:00','2016-03-16 22:50:33.1694004-04:00');
 COMMIT;
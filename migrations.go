@@ -0,0 +1,399 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migrationStep changes the schema inside a transaction.
+type migrationStep func(ctx context.Context, tx *sqlx.Tx, d *dialect) error
+
+// migration is a numbered step in the evolution of the schema, with the
+// statements that apply it and take it back out.
+type migration struct {
+	version     int
+	description string
+	up          migrationStep
+	down        migrationStep
+}
+
+// Migrations in the order they are applied.  Versions must count up from 1,
+// and a migration must never change once it has been released.
+//
+// Statements are written for SQLite and translated by the dialect.  Mixed-case
+// columns are quoted so that PostgreSQL doesn't fold them to lowercase.
+//
+// Databases created before migrations existed already have some of these
+// tables and columns, so the early steps tolerate finding them.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Create Users and Profiles",
+		up: execStatements(`
+CREATE TABLE IF NOT EXISTS Users(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username VARCHAR(255),
+	email VARCHAR(255),
+	verifier BLOB,
+	salt BLOB,
+	access TEXT,
+	active TINYINT(1),
+	"createdAt" DATETIME NOT NULL,
+	"updatedAt" DATETIME NOT NULL
+);`, `
+CREATE TABLE IF NOT EXISTS Profiles(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	clan VARCHAR(255),
+	clantag VARCHAR(255),
+	contactinfo VARCHAR(255),
+	country VARCHAR(255),
+	gravatar TEXT,
+	location VARCHAR(255),
+	message VARCHAR(255),
+	username VARCHAR(255),
+	visible TINYINT(1) DEFAULT 1,
+	visible_lastseen TINYINT(1) DEFAULT 1,
+	"createdAt" DATETIME NOT NULL,
+	"updatedAt" DATETIME NOT NULL,
+	"UserId" INTEGER
+);`),
+		down: execStatements(
+			"DROP TABLE Profiles;",
+			"DROP TABLE Users;"),
+	},
+	{
+		version:     2,
+		description: "Create Servers",
+		up: execStatements(`
+CREATE TABLE IF NOT EXISTS Servers(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255),
+	secret BLOB,
+	networks TEXT,
+	active TINYINT(1),
+	"createdAt" DATETIME NOT NULL,
+	"updatedAt" DATETIME NOT NULL
+);`),
+		down: execStatements("DROP TABLE Servers;"),
+	},
+	{
+		version:     3,
+		description: "Create Sessions",
+		up: execStatements(`
+CREATE TABLE IF NOT EXISTS Sessions(
+	id INTEGER PRIMARY KEY,
+	network VARCHAR(16),
+	address VARCHAR(255),
+	state TINYINT,
+	srp BLOB,
+	"userId" INTEGER,
+	username VARCHAR(255),
+	access TEXT,
+	"srpGroup" VARCHAR(32),
+	"srpHash" VARCHAR(16),
+	version TINYINT,
+	decoy TINYINT(1),
+	unsafe TINYINT(1),
+	expires BIGINT NOT NULL,
+	"ephemeralRequest" BLOB,
+	"ephemeralResponse" BLOB,
+	"proofRequest" BLOB,
+	"proofResponse" BLOB
+);`),
+		down: execStatements("DROP TABLE Sessions;"),
+	},
+	{
+		version:     4,
+		description: "Add SRP group, hash and key derivation to Users",
+		up: addColumns("Users",
+			`"srpGroup" VARCHAR(32) NOT NULL DEFAULT 'rfc5054.2048'`,
+			`"srpHash" VARCHAR(16) NOT NULL DEFAULT 'sha256'`,
+			`kdf VARCHAR(64) NOT NULL DEFAULT 'rfc2945'`),
+		down: execStatements(
+			`ALTER TABLE Users DROP COLUMN kdf;`,
+			`ALTER TABLE Users DROP COLUMN "srpHash";`,
+			`ALTER TABLE Users DROP COLUMN "srpGroup";`),
+	},
+	{
+		version:     5,
+		description: "Make usernames unique",
+		up:          execStatements("CREATE UNIQUE INDEX IF NOT EXISTS users_username ON Users (username);"),
+		down:        execStatements("DROP INDEX users_username;"),
+	},
+	{
+		version:     6,
+		description: "Give every user one profile",
+		up: steps(
+			// Profiles that don't belong to a user can't be reached.
+			execStatements(
+				`DELETE FROM Profiles WHERE "UserId" IS NULL OR "UserId" NOT IN (SELECT id FROM Users);`,
+				`DELETE FROM Profiles WHERE id NOT IN (SELECT MIN(id) FROM Profiles GROUP BY "UserId");`,
+				`INSERT INTO Profiles ("UserId", "createdAt", "updatedAt") SELECT id, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP FROM Users WHERE id NOT IN (SELECT "UserId" FROM Profiles);`),
+			byDriver(map[string]migrationStep{
+				// SQLite can't add constraints to a table, so it is
+				// copied into a new one.
+				"sqlite3": execStatements(`
+CREATE TABLE Profiles_new(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	clan VARCHAR(255),
+	clantag VARCHAR(255),
+	contactinfo VARCHAR(255),
+	country VARCHAR(255),
+	gravatar TEXT,
+	location VARCHAR(255),
+	message VARCHAR(255),
+	username VARCHAR(255),
+	visible TINYINT(1) DEFAULT 1,
+	visible_lastseen TINYINT(1) DEFAULT 1,
+	"createdAt" DATETIME NOT NULL,
+	"updatedAt" DATETIME NOT NULL,
+	"UserId" INTEGER NOT NULL UNIQUE REFERENCES Users (id) ON DELETE CASCADE
+);`,
+					"INSERT INTO Profiles_new SELECT "+profileTableColumns+" FROM Profiles;",
+					"DROP TABLE Profiles;",
+					"ALTER TABLE Profiles_new RENAME TO Profiles;"),
+				"postgres": execStatements(
+					`ALTER TABLE Profiles ALTER COLUMN "UserId" SET NOT NULL;`,
+					`ALTER TABLE Profiles ADD CONSTRAINT profiles_userid_key UNIQUE ("UserId");`,
+					`ALTER TABLE Profiles ADD CONSTRAINT profiles_userid_fkey FOREIGN KEY ("UserId") REFERENCES Users (id) ON DELETE CASCADE;`),
+			})),
+		down: byDriver(map[string]migrationStep{
+			"sqlite3": execStatements(`
+CREATE TABLE Profiles_old(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	clan VARCHAR(255),
+	clantag VARCHAR(255),
+	contactinfo VARCHAR(255),
+	country VARCHAR(255),
+	gravatar TEXT,
+	location VARCHAR(255),
+	message VARCHAR(255),
+	username VARCHAR(255),
+	visible TINYINT(1) DEFAULT 1,
+	visible_lastseen TINYINT(1) DEFAULT 1,
+	"createdAt" DATETIME NOT NULL,
+	"updatedAt" DATETIME NOT NULL,
+	"UserId" INTEGER
+);`,
+				"INSERT INTO Profiles_old SELECT "+profileTableColumns+" FROM Profiles;",
+				"DROP TABLE Profiles;",
+				"ALTER TABLE Profiles_old RENAME TO Profiles;"),
+			"postgres": execStatements(
+				`ALTER TABLE Profiles DROP CONSTRAINT profiles_userid_fkey;`,
+				`ALTER TABLE Profiles DROP CONSTRAINT profiles_userid_key;`,
+				`ALTER TABLE Profiles ALTER COLUMN "UserId" DROP NOT NULL;`),
+		}),
+	},
+}
+
+// profileTableColumns are the columns of Profiles, in the order they were
+// created in.
+const profileTableColumns = `id, clan, clantag, contactinfo, country, gravatar, location, message, username, visible, visible_lastseen, "createdAt", "updatedAt", "UserId"`
+
+// LatestSchemaVersion is the schema version that this version of Charon
+// expects.
+var LatestSchemaVersion = migrations[len(migrations)-1].version
+
+const schemaVersionTable = `
+CREATE TABLE IF NOT EXISTS schema_version(
+	version INTEGER PRIMARY KEY,
+	description VARCHAR(255),
+	"appliedAt" DATETIME NOT NULL
+);`
+
+// execStatements returns a migration step that runs each statement in turn.
+func execStatements(statements ...string) migrationStep {
+	return func(ctx context.Context, tx *sqlx.Tx, d *dialect) (err error) {
+		for _, statement := range statements {
+			_, err = tx.ExecContext(ctx, d.schema(statement))
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+}
+
+// steps returns a migration step that runs several steps in turn.
+func steps(steps ...migrationStep) migrationStep {
+	return func(ctx context.Context, tx *sqlx.Tx, d *dialect) (err error) {
+		for _, step := range steps {
+			err = step(ctx, tx, d)
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+}
+
+// byDriver returns a migration step that runs the step for the database
+// driver in use, for changes that can't be written the same way for every
+// database.
+func byDriver(steps map[string]migrationStep) migrationStep {
+	return func(ctx context.Context, tx *sqlx.Tx, d *dialect) error {
+		step, ok := steps[d.driver]
+		if !ok {
+			return fmt.Errorf("no migration for %s", d.driver)
+		}
+		return step(ctx, tx, d)
+	}
+}
+
+// addColumns returns a migration step that adds columns to a table, skipping
+// the ones it already has.
+func addColumns(table string, columns ...string) migrationStep {
+	return func(ctx context.Context, tx *sqlx.Tx, d *dialect) (err error) {
+		var existing []struct {
+			Name string
+		}
+		err = tx.SelectContext(ctx, &existing, tx.Rebind(d.columns), table)
+		if err != nil {
+			return
+		}
+
+	columns:
+		for _, column := range columns {
+			name := strings.Trim(strings.Fields(column)[0], `"`)
+			for _, have := range existing {
+				if have.Name == name {
+					continue columns
+				}
+			}
+
+			_, err = tx.ExecContext(ctx, d.schema(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s;", table, column)))
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+}
+
+// Migration describes a migration and whether it has been applied.
+type Migration struct {
+	Version     int
+	Description string
+	AppliedAt   *time.Time
+}
+
+// MigrationStatus lists every migration, with the time it was applied if it
+// has been.
+func (database *Database) MigrationStatus(ctx context.Context) (status []Migration, err error) {
+
+	_, err = database.db.ExecContext(ctx, database.dialect.schema(schemaVersionTable))
+	if err != nil {
+		return
+	}
+
+	var applied []struct {
+		Version   int
+		AppliedAt time.Time `db:"appliedAt"`
+	}
+	err = database.db.SelectContext(ctx, &applied, `SELECT version, "appliedAt" FROM schema_version`)
+	if err != nil {
+		return
+	}
+
+	for _, m := range migrations {
+		entry := Migration{Version: m.version, Description: m.description}
+		for i := range applied {
+			if applied[i].Version == m.version {
+				entry.AppliedAt = &applied[i].AppliedAt
+			}
+		}
+		status = append(status, entry)
+	}
+	return
+}
+
+// SchemaVersion returns the version of the newest migration that has been
+// applied, or 0 for an empty database.
+func (database *Database) SchemaVersion(ctx context.Context) (version int, err error) {
+	_, err = database.db.ExecContext(ctx, database.dialect.schema(schemaVersionTable))
+	if err != nil {
+		return
+	}
+	err = database.db.GetContext(ctx, &version, "SELECT COALESCE(MAX(version), 0) FROM schema_version")
+	return
+}
+
+// Migrate applies or reverts migrations until the schema is at the target
+// version.  Every migration runs in its own transaction.
+func (database *Database) Migrate(ctx context.Context, target int) (err error) {
+	if target < 0 || target > LatestSchemaVersion {
+		return fmt.Errorf("unknown schema version %d", target)
+	}
+
+	version, err := database.SchemaVersion(ctx)
+	if err != nil {
+		return
+	}
+
+	for version < target {
+		m := migrations[version]
+		err = database.runMigration(ctx, m, m.up, func(ctx context.Context, tx *sqlx.Tx, d *dialect) error {
+			_, err := tx.ExecContext(ctx, tx.Rebind(`INSERT INTO schema_version (version, description, "appliedAt") VALUES (?, ?, ?)`), m.version, m.description, time.Now())
+			return err
+		})
+		if err != nil {
+			return
+		}
+		version++
+	}
+
+	for version > target {
+		m := migrations[version-1]
+		err = database.runMigration(ctx, m, m.down, func(ctx context.Context, tx *sqlx.Tx, d *dialect) error {
+			_, err := tx.ExecContext(ctx, tx.Rebind("DELETE FROM schema_version WHERE version = ?"), m.version)
+			return err
+		})
+		if err != nil {
+			return
+		}
+		version--
+	}
+
+	return
+}
+
+// runMigration runs one direction of a migration along with the change to
+// schema_version that records it.
+func (database *Database) runMigration(ctx context.Context, m migration, steps ...migrationStep) (err error) {
+	tx, err := database.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	for _, step := range steps {
+		err = step(ctx, tx, database.dialect)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %s", m.version, m.description, err.Error())
+		}
+	}
+
+	return tx.Commit()
+}
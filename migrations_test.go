@@ -0,0 +1,267 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A database as it was created before migrations existed.
+const unversionedSchema = `
+CREATE TABLE Users(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username VARCHAR(255),
+	email VARCHAR(255),
+	verifier BLOB,
+	salt BLOB,
+	access TEXT,
+	active TINYINT(1),
+	createdAt DATETIME NOT NULL,
+	updatedAt DATETIME NOT NULL
+);
+
+CREATE TABLE Profiles(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	clan VARCHAR(255),
+	clantag VARCHAR(255),
+	contactinfo VARCHAR(255),
+	country VARCHAR(255),
+	gravatar TEXT,
+	location VARCHAR(255),
+	message VARCHAR(255),
+	username VARCHAR(255),
+	visible TINYINT(1) DEFAULT 1,
+	visible_lastseen TINYINT(1) DEFAULT 1,
+	createdAt DATETIME NOT NULL,
+	updatedAt DATETIME NOT NULL,
+	UserId INTEGER
+);`
+
+func TestMigrateFixture(t *testing.T) {
+	config := NewConfig(nil)
+	config.Database.Filename = filepath.Join(t.TempDir(), "charon.db")
+
+	database, err := OpenDatabase(config)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer database.Close()
+	_, err = database.db.Exec(unversionedSchema)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = database.Import(context.Background(), "fixture/user.sql")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	err = database.Migrate(context.Background(), LatestSchemaVersion)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	version, err := database.SchemaVersion(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if version != LatestSchemaVersion {
+		t.Errorf("Schema is at version %d instead of %d", version, LatestSchemaVersion)
+	}
+
+	// Existing users get the legacy SRP parameters and can still log in.
+	user, err := database.LoginUser(context.Background(), "testuser", "VsGnJghDUW6C")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if user.SRPGroup != LegacySRPGroup || user.SRPHash != LegacySRPHash || user.KDF != LegacyKDF {
+		t.Errorf("Migrated user uses %s/%s/%s", user.SRPGroup, user.SRPHash, user.KDF)
+	}
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	config := NewConfig(nil)
+	config.Database.Filename = filepath.Join(t.TempDir(), "charon.db")
+
+	database, err := NewDatabase(config)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer database.Close()
+
+	// Every migration can be reverted and applied again.
+	for target := LatestSchemaVersion - 1; target >= 0; target-- {
+		err = database.Migrate(context.Background(), target)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		version, _ := database.SchemaVersion(context.Background())
+		if version != target {
+			t.Fatalf("Schema is at version %d instead of %d", version, target)
+		}
+	}
+	var count int
+	err = database.db.Get(&count, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name IN ('Users', 'Profiles', 'Servers', 'Sessions')")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if count != 0 {
+		t.Errorf("%d tables are left after migrating down", count)
+	}
+
+	err = database.Migrate(context.Background(), LatestSchemaVersion)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = database.Import(context.Background(), "fixture/user.sql")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = database.LoginUser(context.Background(), "testuser", "VsGnJghDUW6C")
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+
+	status, err := database.MigrationStatus(context.Background())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(status) != LatestSchemaVersion {
+		t.Fatalf("Status has %d migrations instead of %d", len(status), LatestSchemaVersion)
+	}
+	for i, m := range status {
+		if m.Version != i+1 || m.AppliedAt == nil {
+			t.Errorf("Migration %d is %v", i+1, m)
+		}
+	}
+
+	err = database.Migrate(context.Background(), LatestSchemaVersion+1)
+	if err == nil {
+		t.Errorf("Migrated to an unknown version")
+	}
+}
+
+func TestNewDatabaseAutoMigrate(t *testing.T) {
+	config := NewConfig(nil)
+	config.Database.Filename = filepath.Join(t.TempDir(), "charon.db")
+	config.Database.AutoMigrate = false
+
+	_, err := NewDatabase(config)
+	if err == nil {
+		t.Fatalf("Database with an outdated schema was opened")
+	}
+
+	database, err := OpenDatabase(config)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = database.Migrate(context.Background(), LatestSchemaVersion)
+	database.Close()
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	database, err = NewDatabase(config)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	database.Close()
+}
+
+func TestMigrateProfiles(t *testing.T) {
+	config := NewConfig(nil)
+	config.Database.Filename = filepath.Join(t.TempDir(), "charon.db")
+
+	database, err := OpenDatabase(config)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer database.Close()
+	ctx := context.Background()
+	err = database.Migrate(ctx, 5)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = database.Import(ctx, "fixture/user.sql")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	// Before profiles were tied to users, a user could have several profiles
+	// or none, and profiles could belong to nobody.
+	now := time.Now()
+	for _, profile := range []struct {
+		clantag string
+		userID  interface{}
+	}{{"FIRST", 1}, {"SECOND", 1}, {"ORPHAN", 99}, {"NOBODY", nil}} {
+		_, err = database.db.Exec("INSERT INTO Profiles (clantag, createdAt, updatedAt, UserId) VALUES (?, ?, ?, ?)", profile.clantag, now, now, profile.userID)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	err = database.AddUser(ctx, "second", "second@example.com", "password")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	_, err = database.db.Exec("DELETE FROM Profiles WHERE UserId = 2")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	err = database.Migrate(ctx, LatestSchemaVersion)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	profiles, err := database.ListProfiles(ctx, 0, 10)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("%d profiles are left instead of 2", len(profiles))
+	}
+	if profiles[0].UserID != 1 || profiles[0].Clantag != "FIRST" {
+		t.Errorf("First user has profile %+v", profiles[0])
+	}
+	user, err := database.FindUser(ctx, "second")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if profiles[1].UserID != user.ID || profiles[1].Clantag != "" {
+		t.Errorf("Second user has profile %+v", profiles[1])
+	}
+
+	// Profiles survive going back and forth.
+	err = database.Migrate(ctx, 5)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = database.Migrate(ctx, LatestSchemaVersion)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	profile, err := database.FindProfile(ctx, 1)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if profile.Clantag != "FIRST" {
+		t.Errorf("First user has profile %+v", profile)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+// Policy decides which users are allowed to authenticate with game servers.
+type Policy struct {
+	AllowInactive   bool
+	AllowUnverified bool
+}
+
+// NewPolicy creates a new Policy from the passed configuration.
+func NewPolicy(config *Config) (policy *Policy) {
+	policy = new(Policy)
+	policy.AllowInactive = config.Auth.AllowInactive
+	policy.AllowUnverified = config.Auth.AllowUnverified
+	return
+}
+
+// Check determines if the passed user may authenticate.  If they may not, the
+// reason is returned as a SessionErrorType suitable for sending to the game
+// server once the user has proven their password.
+func (policy *Policy) Check(user *User) (errType SessionErrorType, ok bool) {
+	if !user.Active && !policy.AllowInactive {
+		return SessionErrorInactive, false
+	}
+	if user.Access == UserAccessUnverified && !policy.AllowUnverified {
+		return SessionErrorUnverified, false
+	}
+
+	return 0, true
+}
@@ -0,0 +1,54 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import "testing"
+
+func TestPolicyCheck(t *testing.T) {
+	tests := []struct {
+		allowInactive   bool
+		allowUnverified bool
+		active          bool
+		access          string
+		ok              bool
+		errType         SessionErrorType
+	}{
+		{false, false, true, UserAccessUser, true, 0},
+		{false, false, true, UserAccessOwner, true, 0},
+		{false, false, false, UserAccessUser, false, SessionErrorInactive},
+		{false, false, true, UserAccessUnverified, false, SessionErrorUnverified},
+		{false, false, false, UserAccessUnverified, false, SessionErrorInactive},
+		{true, false, false, UserAccessUser, true, 0},
+		{false, true, true, UserAccessUnverified, true, 0},
+		{true, true, false, UserAccessUnverified, true, 0},
+	}
+
+	for _, test := range tests {
+		policy := Policy{test.allowInactive, test.allowUnverified}
+		user := User{Active: test.active, Access: test.access}
+
+		errType, ok := policy.Check(&user)
+		if ok != test.ok {
+			t.Errorf("%+v: ok is %v instead of %v", test, ok, test.ok)
+		}
+		if !ok && errType != test.errType {
+			t.Errorf("%+v: error type is %v instead of %v", test, errType, test.errType)
+		}
+	}
+}
@@ -20,8 +20,13 @@ package charon
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"math"
 	"strings"
 )
 
@@ -37,12 +42,101 @@ const (
 	CharonSessionError    uint32 = 0xD003CAEE
 )
 
+// Protocol versions.  The version spoken during a session is the lower of the
+// version sent in the ServerNegotiate and ProtocolVersion.
+const (
+	ProtocolVersionMin uint8 = 2
+	ProtocolVersion    uint8 = 3
+)
+
+// SignatureSize is the size of the trailer that a registered game server
+// appends to its requests.  The trailer consists of the server ID followed by
+// an HMAC-SHA256 of the request and server ID.
+const SignatureSize = 4 + sha256.Size
+
+// SignRequest signs a marshalled request on behalf of a registered game
+// server, returning the request with the signature trailer appended.
+func SignRequest(message []byte, serverID uint32, secret []byte) []byte {
+	signed := make([]byte, len(message), len(message)+SignatureSize)
+	copy(signed, message)
+
+	var id [4]byte
+	binary.LittleEndian.PutUint32(id[:], serverID)
+	signed = append(signed, id[:]...)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signed)
+	return mac.Sum(signed)
+}
+
+// splitSignature splits a signed request into the original request, the
+// server ID and the HMAC.
+func splitSignature(data []byte) (message []byte, serverID uint32, mac []byte, err error) {
+	if len(data) < SignatureSize {
+		err = errors.New("request is not signed")
+		return
+	}
+
+	idOffset := len(data) - SignatureSize
+	macOffset := idOffset + 4
+	message = data[:idOffset]
+	serverID = binary.LittleEndian.Uint32(data[idOffset:macOffset])
+	mac = data[macOffset:]
+	return
+}
+
+// verifySignature checks the HMAC of a signed request against the secret.
+func verifySignature(data []byte, secret []byte) bool {
+	if len(data) < SignatureSize {
+		return false
+	}
+
+	macOffset := len(data) - sha256.Size
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data[:macOffset])
+	return hmac.Equal(mac.Sum(nil), data[macOffset:])
+}
+
+// MaxStreamMessageSize is the largest message that can be sent over a stream
+// transport such as TCP, where every message is prefixed by its length as a
+// little-endian uint16.
+const MaxStreamMessageSize = math.MaxUint16
+
+// WriteStreamMessage writes a message to a stream transport.
+func WriteStreamMessage(w io.Writer, message []byte) (err error) {
+	if len(message) > MaxStreamMessageSize {
+		return fmt.Errorf("message of %d bytes is too large", len(message))
+	}
+
+	frame := make([]byte, 2+len(message))
+	binary.LittleEndian.PutUint16(frame, uint16(len(message)))
+	copy(frame[2:], message)
+	_, err = w.Write(frame)
+	return
+}
+
+// ReadStreamMessage reads a message written by WriteStreamMessage.
+func ReadStreamMessage(r io.Reader) (message []byte, err error) {
+	var length [2]byte
+	_, err = io.ReadFull(r, length[:])
+	if err != nil {
+		return
+	}
+
+	message = make([]byte, binary.LittleEndian.Uint16(length[:]))
+	_, err = io.ReadFull(r, message)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
 // ServerNegotiate is a connection negotiation packet that is sent from the game
 // server to the auth server.
 type ServerNegotiate struct {
-	version       uint8
-	clientSession uint32
-	username      string
+	Version       uint8
+	ClientSession uint32
+	Username      string
 }
 
 // MarshalBinary marshalls a ServerNegotiate from binary data.
@@ -54,17 +148,17 @@ func (packet *ServerNegotiate) MarshalBinary() (data []byte, err error) {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.version)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Version)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.clientSession)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.ClientSession)
 	if err != nil {
 		return
 	}
 
-	_, err = buffer.WriteString(packet.username)
+	_, err = buffer.WriteString(packet.Username)
 	if err != nil {
 		return
 	}
@@ -98,7 +192,7 @@ func (packet *ServerNegotiate) UnmarshalBinary(data []byte) (err error) {
 	}
 	if version == 1 {
 		return errors.New("protocol version 1 is not supported")
-	} else if version != 2 {
+	} else if version < ProtocolVersionMin || version > ProtocolVersion {
 		return errors.New("packet has unknown protocol version")
 	}
 
@@ -113,20 +207,23 @@ func (packet *ServerNegotiate) UnmarshalBinary(data []byte) (err error) {
 		return
 	}
 
-	packet.version = version
-	packet.clientSession = clientSession
-	packet.username = strings.TrimRight(username, "\x00")
+	packet.Version = version
+	packet.ClientSession = clientSession
+	packet.Username = strings.TrimRight(username, "\x00")
 	return
 }
 
 // AuthNegotiate is a connection negotiation packet that is sent from the auth
 // server to the game server.
 type AuthNegotiate struct {
-	version       uint8
-	clientSession uint32
-	session       uint32
-	salt          []byte
-	username      string
+	Version       uint8
+	ClientSession uint32
+	Session       uint32
+	Salt          []byte
+	Username      string
+	Group         string // SRP group of the user's verifier, version 3 only
+	Hash          string // SRP hash of the user's verifier, version 3 only
+	KDF           string // Key derivation of the user's verifier, version 3 only
 }
 
 // MarshalBinary marshalls an AuthNegotiate from binary data.
@@ -138,39 +235,45 @@ func (packet *AuthNegotiate) MarshalBinary() (data []byte, err error) {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.version)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Version)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.clientSession)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.ClientSession)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.session)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Session)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, uint8(len(packet.salt)))
+	err = binary.Write(&buffer, binary.LittleEndian, uint8(len(packet.Salt)))
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.salt)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Salt)
 	if err != nil {
 		return
 	}
 
-	_, err = buffer.WriteString(packet.username)
-	if err != nil {
-		return
+	strs := []string{packet.Username}
+	if packet.Version >= 3 {
+		strs = append(strs, packet.Group, packet.Hash, packet.KDF)
 	}
+	for _, str := range strs {
+		_, err = buffer.WriteString(str)
+		if err != nil {
+			return
+		}
 
-	err = buffer.WriteByte(0)
-	if err != nil {
-		return
+		err = buffer.WriteByte(0)
+		if err != nil {
+			return
+		}
 	}
 
 	data = buffer.Bytes()
@@ -197,7 +300,7 @@ func (packet *AuthNegotiate) UnmarshalBinary(data []byte) (err error) {
 	}
 	if version == 1 {
 		return errors.New("protocol version 1 is not supported")
-	} else if version != 2 {
+	} else if version < ProtocolVersionMin || version > ProtocolVersion {
 		return errors.New("packet has unknown protocol version")
 	}
 
@@ -225,24 +328,40 @@ func (packet *AuthNegotiate) UnmarshalBinary(data []byte) (err error) {
 		return
 	}
 
-	username, err := buffer.ReadString(0)
-	if err != nil {
-		return
+	strs := make([]string, 1, 4)
+	if version >= 3 {
+		strs = strs[:4]
+	}
+	for i := range strs {
+		strs[i], err = buffer.ReadString(0)
+		if err != nil {
+			return
+		}
+		strs[i] = strings.TrimRight(strs[i], "\x00")
 	}
 
-	packet.version = version
-	packet.clientSession = clientSession
-	packet.session = session
-	packet.salt = salt
-	packet.username = strings.TrimRight(username, "\x00")
+	packet.Version = version
+	packet.ClientSession = clientSession
+	packet.Session = session
+	packet.Salt = salt
+	packet.Username = strs[0]
+	if version >= 3 {
+		packet.Group = strs[1]
+		packet.Hash = strs[2]
+		packet.KDF = strs[3]
+	} else {
+		packet.Group = LegacySRPGroup
+		packet.Hash = LegacySRPHash
+		packet.KDF = LegacyKDF
+	}
 	return
 }
 
 // ServerEphemeral contains an SRP ephemeral value sent from the game server to
 // the auth server.
 type ServerEphemeral struct {
-	session   uint32
-	ephemeral []byte
+	Session   uint32
+	Ephemeral []byte
 }
 
 // MarshalBinary marshalls a ServerEphemeral from binary data.
@@ -254,17 +373,17 @@ func (packet *ServerEphemeral) MarshalBinary() (data []byte, err error) {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.session)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Session)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, uint16(len(packet.ephemeral)))
+	err = binary.Write(&buffer, binary.LittleEndian, uint16(len(packet.Ephemeral)))
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.ephemeral)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Ephemeral)
 	if err != nil {
 		return
 	}
@@ -304,16 +423,16 @@ func (packet *ServerEphemeral) UnmarshalBinary(data []byte) (err error) {
 		return
 	}
 
-	packet.session = session
-	packet.ephemeral = ephemeral
+	packet.Session = session
+	packet.Ephemeral = ephemeral
 	return
 }
 
 // AuthEphemeral contains an SRP ephemeral value sent from the auth server to
 // the game server.
 type AuthEphemeral struct {
-	session   uint32
-	ephemeral []byte
+	Session   uint32
+	Ephemeral []byte
 }
 
 // MarshalBinary marshalls an AuthEphemeral from binary data.
@@ -325,17 +444,17 @@ func (packet *AuthEphemeral) MarshalBinary() (data []byte, err error) {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.session)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Session)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, uint16(len(packet.ephemeral)))
+	err = binary.Write(&buffer, binary.LittleEndian, uint16(len(packet.Ephemeral)))
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.ephemeral)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Ephemeral)
 	if err != nil {
 		return
 	}
@@ -375,16 +494,16 @@ func (packet *AuthEphemeral) UnmarshalBinary(data []byte) (err error) {
 		return
 	}
 
-	packet.session = session
-	packet.ephemeral = ephemeral
+	packet.Session = session
+	packet.Ephemeral = ephemeral
 	return
 }
 
 // ServerProof contains a SRP proof value sent from the game server to
 // the auth server.
 type ServerProof struct {
-	session uint32
-	proof   []byte
+	Session uint32
+	Proof   []byte
 }
 
 // MarshalBinary marshalls a ServerProof from binary data.
@@ -396,17 +515,17 @@ func (packet *ServerProof) MarshalBinary() (data []byte, err error) {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.session)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Session)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, uint16(len(packet.proof)))
+	err = binary.Write(&buffer, binary.LittleEndian, uint16(len(packet.Proof)))
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.proof)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Proof)
 	if err != nil {
 		return
 	}
@@ -446,16 +565,22 @@ func (packet *ServerProof) UnmarshalBinary(data []byte) (err error) {
 		return
 	}
 
-	packet.session = session
-	packet.proof = proof
+	packet.Session = session
+	packet.Proof = proof
 	return
 }
 
 // AuthProof contains a SRP proof value sent from the auth server to
-// the game server.
+// the game server.  Starting with protocol version 3, it also contains
+// information about the authenticated user.
 type AuthProof struct {
-	session uint32
-	proof   []byte
+	Version  uint8 // Not sent, determines which fields are sent
+	Session  uint32
+	Proof    []byte
+	Username string
+	Access   string
+	Clantag  string
+	Country  string
 }
 
 // MarshalBinary marshalls an AuthProof from binary data.
@@ -467,21 +592,35 @@ func (packet *AuthProof) MarshalBinary() (data []byte, err error) {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.session)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Session)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, uint16(len(packet.proof)))
+	err = binary.Write(&buffer, binary.LittleEndian, uint16(len(packet.Proof)))
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.proof)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Proof)
 	if err != nil {
 		return
 	}
 
+	if packet.Version >= 3 {
+		for _, str := range []string{packet.Username, packet.Access, packet.Clantag, packet.Country} {
+			_, err = buffer.WriteString(str)
+			if err != nil {
+				return
+			}
+
+			err = buffer.WriteByte(0)
+			if err != nil {
+				return
+			}
+		}
+	}
+
 	data = buffer.Bytes()
 	return
 }
@@ -517,25 +656,147 @@ func (packet *AuthProof) UnmarshalBinary(data []byte) (err error) {
 		return
 	}
 
-	packet.session = session
-	packet.proof = proof
+	// Version 2 packets end here.
+	var version uint8 = 2
+	var strs [4]string
+	if buffer.Len() > 0 {
+		version = 3
+		for i := range strs {
+			strs[i], err = buffer.ReadString(0)
+			if err != nil {
+				return
+			}
+			strs[i] = strings.TrimRight(strs[i], "\x00")
+		}
+	}
+
+	packet.Version = version
+	packet.Session = session
+	packet.Proof = proof
+	packet.Username = strs[0]
+	packet.Access = strs[1]
+	packet.Clantag = strs[2]
+	packet.Country = strs[3]
 	return
 }
 
+// UserErrorType is the reason a UserError was sent.
+type UserErrorType uint8
+
+// User error constants.
+const (
+	UserErrorTryLater UserErrorType = iota
+	UserErrorNoExist
+	UserErrorOutdatedProtocol
+	UserErrorWillNotAuth
+	UserErrorInactive
+	UserErrorBanned
+	UserErrorUnverified
+)
+
+// UserError is sent from the auth server to the game server when a
+// negotiation cannot proceed for the requested user.
+type UserError struct {
+	ErrType       UserErrorType
+	ClientSession uint32
+}
+
+// MarshalBinary marshalls a UserError from binary data.
+func (packet *UserError) MarshalBinary() (data []byte, err error) {
+	var buffer bytes.Buffer
+
+	err = binary.Write(&buffer, binary.LittleEndian, CharonUserError)
+	if err != nil {
+		return
+	}
+
+	err = binary.Write(&buffer, binary.LittleEndian, packet.ErrType)
+	if err != nil {
+		return
+	}
+
+	err = binary.Write(&buffer, binary.LittleEndian, packet.ClientSession)
+	if err != nil {
+		return
+	}
+
+	data = buffer.Bytes()
+	return
+}
+
+// UnmarshalBinary unmarshalls a UserError to binary data.
+func (packet *UserError) UnmarshalBinary(data []byte) (err error) {
+	buffer := bytes.NewBuffer(data)
+
+	var header uint32
+	err = binary.Read(buffer, binary.LittleEndian, &header)
+	if err != nil {
+		return
+	}
+	if header != CharonUserError {
+		return errors.New("packet has incorrect header")
+	}
+
+	var errType UserErrorType
+	err = binary.Read(buffer, binary.LittleEndian, &errType)
+	if err != nil {
+		return
+	}
+
+	var clientSession uint32
+	err = binary.Read(buffer, binary.LittleEndian, &clientSession)
+	if err != nil {
+		return
+	}
+
+	packet.ErrType = errType
+	packet.ClientSession = clientSession
+	return
+}
+
+// Error allows a received UserError to be returned as an error.
+func (packet *UserError) Error() string {
+	switch packet.ErrType {
+	case UserErrorTryLater:
+		return "charon: user error: try again later"
+	case UserErrorNoExist:
+		return "charon: user error: user does not exist"
+	case UserErrorOutdatedProtocol:
+		return "charon: user error: outdated protocol"
+	case UserErrorWillNotAuth:
+		return "charon: user error: server will not authenticate"
+	case UserErrorInactive:
+		return "charon: user error: user is inactive"
+	case UserErrorBanned:
+		return "charon: user error: user is banned"
+	case UserErrorUnverified:
+		return "charon: user error: user is unverified"
+	default:
+		return fmt.Sprintf("charon: user error: unknown error %d", packet.ErrType)
+	}
+}
+
+// SessionErrorType is the reason a SessionError was sent.
 type SessionErrorType uint8
 
+// Session error constants.
 const (
 	SessionErrorTryLater SessionErrorType = iota
 	SessionErrorNoExist
 	SessionErrorVerifierUnsafe
 	SessionErrorAuthFailed
+	SessionErrorInactive
+	SessionErrorUnverified
 )
 
+// SessionError is sent from the auth server to the game server when an
+// existing session cannot proceed.
 type SessionError struct {
-	errType SessionErrorType
-	session uint32
+	ErrType SessionErrorType
+	Session uint32
 }
 
+// MarshalBinary marshalls a SessionError from binary data.
 func (packet *SessionError) MarshalBinary() (data []byte, err error) {
 	var buffer bytes.Buffer
 
@@ -544,12 +805,12 @@ func (packet *SessionError) MarshalBinary() (data []byte, err error) {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.errType)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.ErrType)
 	if err != nil {
 		return
 	}
 
-	err = binary.Write(&buffer, binary.LittleEndian, packet.session)
+	err = binary.Write(&buffer, binary.LittleEndian, packet.Session)
 	if err != nil {
 		return
 	}
@@ -558,6 +819,52 @@ func (packet *SessionError) MarshalBinary() (data []byte, err error) {
 	return
 }
 
+// UnmarshalBinary unmarshalls a SessionError to binary data.
 func (packet *SessionError) UnmarshalBinary(data []byte) (err error) {
+	buffer := bytes.NewBuffer(data)
+
+	var header uint32
+	err = binary.Read(buffer, binary.LittleEndian, &header)
+	if err != nil {
+		return
+	}
+	if header != CharonSessionError {
+		return errors.New("packet has incorrect header")
+	}
+
+	var errType SessionErrorType
+	err = binary.Read(buffer, binary.LittleEndian, &errType)
+	if err != nil {
+		return
+	}
+
+	var session uint32
+	err = binary.Read(buffer, binary.LittleEndian, &session)
+	if err != nil {
+		return
+	}
+
+	packet.ErrType = errType
+	packet.Session = session
 	return
 }
+
+// Error allows a received SessionError to be returned as an error.
+func (packet *SessionError) Error() string {
+	switch packet.ErrType {
+	case SessionErrorTryLater:
+		return "charon: session error: try again later"
+	case SessionErrorNoExist:
+		return "charon: session error: session does not exist"
+	case SessionErrorVerifierUnsafe:
+		return "charon: session error: verifier is unsafe"
+	case SessionErrorAuthFailed:
+		return "charon: session error: authentication failed"
+	case SessionErrorInactive:
+		return "charon: session error: user is inactive"
+	case SessionErrorUnverified:
+		return "charon: session error: user is unverified"
+	default:
+		return fmt.Sprintf("charon: session error: unknown error %d", packet.ErrType)
+	}
+}
@@ -20,6 +20,7 @@ package charon
 
 import (
 	"bytes"
+	"io"
 	"testing"
 )
 
@@ -27,9 +28,9 @@ func TestServerNegotiateMarshall(t *testing.T) {
 	expected := []byte("\x01\xCA\x03\xD0\x02\xCC\xDD\xEE\xFFusername\x00")
 
 	var packet ServerNegotiate
-	packet.username = "username"
-	packet.version = 2
-	packet.clientSession = 4293844428
+	packet.Username = "username"
+	packet.Version = 2
+	packet.ClientSession = 4293844428
 
 	actual, err := packet.MarshalBinary()
 	if err != nil {
@@ -48,14 +49,27 @@ func TestServerNegotiateUnmarshall(t *testing.T) {
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
-	if packet.version != 2 {
-		t.Errorf("Version is %v instead of 2", packet.version)
+	if packet.Version != 2 {
+		t.Errorf("Version is %v instead of 2", packet.Version)
 	}
-	if packet.clientSession != 4293844428 {
-		t.Errorf("Client Session is %v instead of 4293844428", packet.clientSession)
+	if packet.ClientSession != 4293844428 {
+		t.Errorf("Client Session is %v instead of 4293844428", packet.ClientSession)
 	}
-	if packet.username != "username" {
-		t.Errorf("Username is %v instead of username", packet.username)
+	if packet.Username != "username" {
+		t.Errorf("Username is %v instead of username", packet.Username)
+	}
+}
+
+func TestServerNegotiateUnmarshallV3(t *testing.T) {
+	valid := []byte("\x01\xCA\x03\xD0\x03\xCC\xDD\xEE\xFFusername\x00")
+
+	var packet ServerNegotiate
+	err := packet.UnmarshalBinary(valid)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	if packet.Version != 3 {
+		t.Errorf("Version is %v instead of 3", packet.Version)
 	}
 }
 
@@ -85,11 +99,11 @@ func TestAuthNegotiateMarshall(t *testing.T) {
 	expected := []byte("\x10\xCA\x03\xD0\x02\xCC\xDD\xEE\xFF\xFF\xFF\xFF\xFF\x04\x88\x88\x88\x88username\x00")
 
 	var packet AuthNegotiate
-	packet.version = 2
-	packet.clientSession = 4293844428
-	packet.session = 4294967295
-	packet.salt = []byte("\x88\x88\x88\x88")
-	packet.username = "username"
+	packet.Version = 2
+	packet.ClientSession = 4293844428
+	packet.Session = 4294967295
+	packet.Salt = []byte("\x88\x88\x88\x88")
+	packet.Username = "username"
 
 	actual, err := packet.MarshalBinary()
 	if err != nil {
@@ -108,20 +122,20 @@ func TestAuthNegotiateUnmarshall(t *testing.T) {
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
-	if packet.version != 2 {
-		t.Errorf("Version is %v instead of 2", packet.version)
+	if packet.Version != 2 {
+		t.Errorf("Version is %v instead of 2", packet.Version)
 	}
-	if packet.clientSession != 4293844428 {
-		t.Errorf("Client Session is %v instead of 4293844428", packet.clientSession)
+	if packet.ClientSession != 4293844428 {
+		t.Errorf("Client Session is %v instead of 4293844428", packet.ClientSession)
 	}
-	if packet.session != 4294967295 {
-		t.Errorf("Session is %v instead of 4294967295", packet.session)
+	if packet.Session != 4294967295 {
+		t.Errorf("Session is %v instead of 4294967295", packet.Session)
 	}
-	if !bytes.Equal(packet.salt, []byte{136, 136, 136, 136}) {
-		t.Errorf("Salt is %v instead of [136 136 136 136]", packet.salt)
+	if !bytes.Equal(packet.Salt, []byte{136, 136, 136, 136}) {
+		t.Errorf("Salt is %v instead of [136 136 136 136]", packet.Salt)
 	}
-	if packet.username != "username" {
-		t.Errorf("Username is %v instead of username", packet.username)
+	if packet.Username != "username" {
+		t.Errorf("Username is %v instead of username", packet.Username)
 	}
 }
 
@@ -149,12 +163,64 @@ func TestAuthNegotiateUnmarshallErrors(t *testing.T) {
 	}
 }
 
+func TestAuthNegotiateV3(t *testing.T) {
+	expected := []byte("\x10\xCA\x03\xD0\x03\xCC\xDD\xEE\xFF\xFF\xFF\xFF\xFF\x04\x88\x88\x88\x88username\x00rfc5054.3072\x00sha512\x00scrypt:N=16384,r=8,p=1\x00")
+
+	var packet AuthNegotiate
+	packet.Version = 3
+	packet.ClientSession = 4293844428
+	packet.Session = 4294967295
+	packet.Salt = []byte("\x88\x88\x88\x88")
+	packet.Username = "username"
+	packet.Group = "rfc5054.3072"
+	packet.Hash = "sha512"
+	packet.KDF = "scrypt:N=16384,r=8,p=1"
+
+	actual, err := packet.MarshalBinary()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("Expected: %v Actual: %v", expected, actual)
+	}
+
+	var unmarshalled AuthNegotiate
+	err = unmarshalled.UnmarshalBinary(expected)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if unmarshalled.Group != "rfc5054.3072" || unmarshalled.Hash != "sha512" {
+		t.Errorf("Group and hash are %s/%s instead of rfc5054.3072/sha512", unmarshalled.Group, unmarshalled.Hash)
+	}
+	if unmarshalled.KDF != "scrypt:N=16384,r=8,p=1" {
+		t.Errorf("KDF is %s instead of scrypt:N=16384,r=8,p=1", unmarshalled.KDF)
+	}
+
+	// Version 2 always means the legacy group, hash and key derivation.
+	err = unmarshalled.UnmarshalBinary([]byte("\x10\xCA\x03\xD0\x02\xCC\xDD\xEE\xFF\xFF\xFF\xFF\xFF\x04\x88\x88\x88\x88username\x00"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if unmarshalled.Group != LegacySRPGroup || unmarshalled.Hash != LegacySRPHash {
+		t.Errorf("Group and hash are %s/%s instead of %s/%s", unmarshalled.Group, unmarshalled.Hash, LegacySRPGroup, LegacySRPHash)
+	}
+	if unmarshalled.KDF != LegacyKDF {
+		t.Errorf("KDF is %s instead of %s", unmarshalled.KDF, LegacyKDF)
+	}
+
+	// Version 3 without a group and hash
+	err = unmarshalled.UnmarshalBinary([]byte("\x10\xCA\x03\xD0\x03\xCC\xDD\xEE\xFF\xFF\xFF\xFF\xFF\x04\x88\x88\x88\x88username\x00"))
+	if err == nil {
+		t.Errorf("Version 3 packet without a group was incorrectly parsed as valid")
+	}
+}
+
 func TestServerEphemeralMarshall(t *testing.T) {
 	expected := []byte("\x02\xCA\x03\xD0\xFF\xFF\xFF\xFF\x04\x00\x88\x88\x88\x88")
 
 	var packet ServerEphemeral
-	packet.session = 4294967295
-	packet.ephemeral = []byte("\x88\x88\x88\x88")
+	packet.Session = 4294967295
+	packet.Ephemeral = []byte("\x88\x88\x88\x88")
 
 	actual, err := packet.MarshalBinary()
 	if err != nil {
@@ -173,11 +239,11 @@ func TestServerEphemeralUnmarshall(t *testing.T) {
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
-	if 4294967295 != packet.session {
-		t.Errorf("Session is %v instead of 4294967295", packet.session)
+	if 4294967295 != packet.Session {
+		t.Errorf("Session is %v instead of 4294967295", packet.Session)
 	}
-	if !bytes.Equal([]byte{136, 136, 136, 136}, packet.ephemeral) {
-		t.Errorf("Ephemeral is %v instead of [136 136 136 136]", packet.ephemeral)
+	if !bytes.Equal([]byte{136, 136, 136, 136}, packet.Ephemeral) {
+		t.Errorf("Ephemeral is %v instead of [136 136 136 136]", packet.Ephemeral)
 	}
 }
 
@@ -205,8 +271,8 @@ func TestAuthEphemeralMarshall(t *testing.T) {
 	expected := []byte("\x20\xCA\x03\xD0\xFF\xFF\xFF\xFF\x04\x00\x88\x88\x88\x88")
 
 	var packet AuthEphemeral
-	packet.session = 4294967295
-	packet.ephemeral = []byte("\x88\x88\x88\x88")
+	packet.Session = 4294967295
+	packet.Ephemeral = []byte("\x88\x88\x88\x88")
 
 	actual, err := packet.MarshalBinary()
 	if err != nil {
@@ -225,11 +291,11 @@ func TestAuthEphemeralUnmarshall(t *testing.T) {
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
-	if 4294967295 != packet.session {
-		t.Errorf("Session is %v instead of 4294967295", packet.session)
+	if 4294967295 != packet.Session {
+		t.Errorf("Session is %v instead of 4294967295", packet.Session)
 	}
-	if !bytes.Equal([]byte{136, 136, 136, 136}, packet.ephemeral) {
-		t.Errorf("Ephemeral is %v instead of [136 136 136 136]", packet.ephemeral)
+	if !bytes.Equal([]byte{136, 136, 136, 136}, packet.Ephemeral) {
+		t.Errorf("Ephemeral is %v instead of [136 136 136 136]", packet.Ephemeral)
 	}
 }
 
@@ -257,8 +323,8 @@ func TestServerProofMarshall(t *testing.T) {
 	expected := []byte("\x03\xCA\x03\xD0\xFF\xFF\xFF\xFF\x04\x00\x88\x88\x88\x88")
 
 	var packet ServerProof
-	packet.session = 4294967295
-	packet.proof = []byte("\x88\x88\x88\x88")
+	packet.Session = 4294967295
+	packet.Proof = []byte("\x88\x88\x88\x88")
 
 	actual, err := packet.MarshalBinary()
 	if err != nil {
@@ -277,11 +343,11 @@ func TestServerProofUnmarshall(t *testing.T) {
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
-	if 4294967295 != packet.session {
-		t.Errorf("Session is %v instead of 4294967295", packet.session)
+	if 4294967295 != packet.Session {
+		t.Errorf("Session is %v instead of 4294967295", packet.Session)
 	}
-	if !bytes.Equal([]byte{136, 136, 136, 136}, packet.proof) {
-		t.Errorf("Ephemeral is %v instead of [136 136 136 136]", packet.proof)
+	if !bytes.Equal([]byte{136, 136, 136, 136}, packet.Proof) {
+		t.Errorf("Ephemeral is %v instead of [136 136 136 136]", packet.Proof)
 	}
 }
 
@@ -309,8 +375,8 @@ func TestAuthProofMarshall(t *testing.T) {
 	expected := []byte("\x30\xCA\x03\xD0\xFF\xFF\xFF\xFF\x04\x00\x88\x88\x88\x88")
 
 	var packet AuthProof
-	packet.session = 4294967295
-	packet.proof = []byte("\x88\x88\x88\x88")
+	packet.Session = 4294967295
+	packet.Proof = []byte("\x88\x88\x88\x88")
 
 	actual, err := packet.MarshalBinary()
 	if err != nil {
@@ -329,11 +395,11 @@ func TestAuthProofUnmarshall(t *testing.T) {
 	if err != nil {
 		t.Errorf("%s", err.Error())
 	}
-	if 4294967295 != packet.session {
-		t.Errorf("Session is %v instead of 4294967295", packet.session)
+	if 4294967295 != packet.Session {
+		t.Errorf("Session is %v instead of 4294967295", packet.Session)
 	}
-	if !bytes.Equal([]byte{136, 136, 136, 136}, packet.proof) {
-		t.Errorf("Ephemeral is %v instead of [136 136 136 136]", packet.proof)
+	if !bytes.Equal([]byte{136, 136, 136, 136}, packet.Proof) {
+		t.Errorf("Ephemeral is %v instead of [136 136 136 136]", packet.Proof)
 	}
 }
 
@@ -356,3 +422,240 @@ func TestAuthProofUnmarshallErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestUserErrorMarshall(t *testing.T) {
+	expected := []byte("\xFF\xCA\x03\xD0\x01\xCC\xDD\xEE\xFF")
+
+	var packet UserError
+	packet.ErrType = UserErrorNoExist
+	packet.ClientSession = 4293844428
+
+	actual, err := packet.MarshalBinary()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("Expected: %v Actual: %v", expected, actual)
+	}
+}
+
+func TestUserErrorUnmarshall(t *testing.T) {
+	valid := []byte("\xFF\xCA\x03\xD0\x01\xCC\xDD\xEE\xFF")
+
+	var packet UserError
+	err := packet.UnmarshalBinary(valid)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	if packet.ErrType != UserErrorNoExist {
+		t.Errorf("Error type is %v instead of %v", packet.ErrType, UserErrorNoExist)
+	}
+	if packet.ClientSession != 4293844428 {
+		t.Errorf("Client Session is %v instead of 4293844428", packet.ClientSession)
+	}
+}
+
+func TestUserErrorUnmarshallErrors(t *testing.T) {
+	errors := [][]byte{
+		// Too short
+		[]byte("\xFF\xCA"),
+		// Incorrect header
+		[]byte("\xFF\xCA\x03\xD1"),
+		// Missing client session
+		[]byte("\xFF\xCA\x03\xD0\x01\xCC\xDD"),
+	}
+
+	var err error
+	var packet UserError
+	for _, test := range errors {
+		err = packet.UnmarshalBinary(test)
+		if err == nil {
+			t.Errorf("%v was incorrectly parsed as valid", test)
+		}
+	}
+}
+
+func TestSessionErrorMarshall(t *testing.T) {
+	expected := []byte("\xEE\xCA\x03\xD0\x03\xFF\xFF\xFF\xFF")
+
+	var packet SessionError
+	packet.ErrType = SessionErrorAuthFailed
+	packet.Session = 4294967295
+
+	actual, err := packet.MarshalBinary()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("Expected: %v Actual: %v", expected, actual)
+	}
+}
+
+func TestSessionErrorUnmarshall(t *testing.T) {
+	valid := []byte("\xEE\xCA\x03\xD0\x03\xFF\xFF\xFF\xFF")
+
+	var packet SessionError
+	err := packet.UnmarshalBinary(valid)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	if packet.ErrType != SessionErrorAuthFailed {
+		t.Errorf("Error type is %v instead of %v", packet.ErrType, SessionErrorAuthFailed)
+	}
+	if packet.Session != 4294967295 {
+		t.Errorf("Session is %v instead of 4294967295", packet.Session)
+	}
+}
+
+func TestSessionErrorUnmarshallErrors(t *testing.T) {
+	errors := [][]byte{
+		// Too short
+		[]byte("\xEE\xCA"),
+		// Incorrect header
+		[]byte("\xEE\xCA\x03\xD1"),
+		// Missing session
+		[]byte("\xEE\xCA\x03\xD0\x03\xFF\xFF"),
+	}
+
+	var err error
+	var packet SessionError
+	for _, test := range errors {
+		err = packet.UnmarshalBinary(test)
+		if err == nil {
+			t.Errorf("%v was incorrectly parsed as valid", test)
+		}
+	}
+}
+
+func TestAuthProofMarshallV3(t *testing.T) {
+	expected := []byte("\x30\xCA\x03\xD0\xFF\xFF\xFF\xFF\x04\x00\x88\x88\x88\x88username\x00OP\x00TAG\x00CA\x00")
+
+	var packet AuthProof
+	packet.Version = 3
+	packet.Session = 4294967295
+	packet.Proof = []byte("\x88\x88\x88\x88")
+	packet.Username = "username"
+	packet.Access = UserAccessOp
+	packet.Clantag = "TAG"
+	packet.Country = "CA"
+
+	actual, err := packet.MarshalBinary()
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("Expected: %v Actual: %v", expected, actual)
+	}
+}
+
+func TestAuthProofUnmarshallV3(t *testing.T) {
+	valid := []byte("\x30\xCA\x03\xD0\xFF\xFF\xFF\xFF\x04\x00\x88\x88\x88\x88username\x00OP\x00\x00CA\x00")
+
+	var packet AuthProof
+	err := packet.UnmarshalBinary(valid)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	if packet.Version != 3 {
+		t.Errorf("Version is %v instead of 3", packet.Version)
+	}
+	if packet.Username != "username" {
+		t.Errorf("Username is %v instead of username", packet.Username)
+	}
+	if packet.Access != UserAccessOp {
+		t.Errorf("Access is %v instead of %v", packet.Access, UserAccessOp)
+	}
+	if packet.Clantag != "" {
+		t.Errorf("Clantag is %v instead of empty", packet.Clantag)
+	}
+	if packet.Country != "CA" {
+		t.Errorf("Country is %v instead of CA", packet.Country)
+	}
+}
+
+func TestAuthProofUnmarshallV3Errors(t *testing.T) {
+	errors := [][]byte{
+		// Missing access
+		[]byte("\x30\xCA\x03\xD0\xFF\xFF\xFF\xFF\x04\x00\x88\x88\x88\x88username\x00"),
+		// Missing country null terminator
+		[]byte("\x30\xCA\x03\xD0\xFF\xFF\xFF\xFF\x04\x00\x88\x88\x88\x88username\x00OP\x00TAG\x00CA"),
+	}
+
+	var err error
+	var packet AuthProof
+	for _, test := range errors {
+		err = packet.UnmarshalBinary(test)
+		if err == nil {
+			t.Errorf("%v was incorrectly parsed as valid", test)
+		}
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	message := []byte("\x01\xCA\x03\xD0\x02\xCC\xDD\xEE\xFFusername\x00")
+	secret := []byte("secret")
+
+	signed := SignRequest(message, 42, secret)
+	if len(signed) != len(message)+SignatureSize {
+		t.Fatalf("Signed request is %d bytes instead of %d", len(signed), len(message)+SignatureSize)
+	}
+	if !verifySignature(signed, secret) {
+		t.Errorf("Signature did not verify")
+	}
+	if verifySignature(signed, []byte("wrong")) {
+		t.Errorf("Signature verified with the wrong secret")
+	}
+
+	original, serverID, _, err := splitSignature(signed)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	if !bytes.Equal(original, message) {
+		t.Errorf("Expected: %v Actual: %v", message, original)
+	}
+	if serverID != 42 {
+		t.Errorf("Server ID is %v instead of 42", serverID)
+	}
+
+	// Tamper with the server ID
+	signed[len(message)] = 43
+	if verifySignature(signed, secret) {
+		t.Errorf("Signature verified with a tampered server ID")
+	}
+}
+
+func TestStreamMessage(t *testing.T) {
+	var buffer bytes.Buffer
+	messages := [][]byte{
+		[]byte("\x01\xCA\x03\xD0"),
+		{},
+		bytes.Repeat([]byte("x"), MaxStreamMessageSize),
+	}
+
+	for _, message := range messages {
+		err := WriteStreamMessage(&buffer, message)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+	}
+	for _, message := range messages {
+		actual, err := ReadStreamMessage(&buffer)
+		if err != nil {
+			t.Fatalf("%s", err.Error())
+		}
+		if !bytes.Equal(actual, message) {
+			t.Errorf("Message of %d bytes was read back as %d bytes", len(message), len(actual))
+		}
+	}
+
+	err := WriteStreamMessage(&buffer, make([]byte, MaxStreamMessageSize+1))
+	if err == nil {
+		t.Errorf("Oversized message was incorrectly written")
+	}
+
+	// Truncated message
+	_, err = ReadStreamMessage(bytes.NewBufferString("\x04\x00\x01\xCA"))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Truncated message returned %v instead of %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"sync"
+	"time"
+)
+
+// How often idle buckets are thrown away.
+const rateLimiterPruneInterval = time.Minute
+
+// rateLimiter is a set of token buckets keyed by an arbitrary string.  A
+// rateLimiter with a rate of zero or less allows everything.
+type rateLimiter struct {
+	rate      float64 // Tokens added per second
+	burst     float64 // Maximum number of tokens in a bucket
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	mutex     sync.Mutex
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a new rateLimiter.
+func newRateLimiter(rate float64, burst int) (limiter *rateLimiter) {
+	limiter = new(rateLimiter)
+	limiter.rate = rate
+	limiter.burst = float64(burst)
+	if limiter.burst < 1 {
+		limiter.burst = 1
+	}
+	limiter.buckets = make(map[string]*bucket)
+	limiter.now = time.Now
+	limiter.lastPrune = limiter.now()
+	return
+}
+
+// Allow takes a token from the bucket for the passed key, returning false if
+// the bucket is empty.
+func (limiter *rateLimiter) Allow(key string) bool {
+	if limiter.rate <= 0 {
+		return true
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	if now.Sub(limiter.lastPrune) >= rateLimiterPruneInterval {
+		limiter.prune(now)
+	}
+
+	b, exists := limiter.buckets[key]
+	if exists == false {
+		b = &bucket{tokens: limiter.burst, last: now}
+		limiter.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limiter.rate
+		if b.tokens > limiter.burst {
+			b.tokens = limiter.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune throws away buckets that would have refilled completely, since they
+// are no different from a new bucket.
+func (limiter *rateLimiter) prune(now time.Time) {
+	full := time.Duration(limiter.burst / limiter.rate * float64(time.Second))
+	for key, b := range limiter.buckets {
+		if now.Sub(b.last) >= full {
+			delete(limiter.buckets, key)
+		}
+	}
+	limiter.lastPrune = now
+}
@@ -0,0 +1,81 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	// Burst is allowed immediately
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("a") {
+			t.Errorf("Request %d was not allowed", i+1)
+		}
+	}
+	if limiter.Allow("a") {
+		t.Errorf("Request past the burst was allowed")
+	}
+
+	// Other keys have their own bucket
+	if !limiter.Allow("b") {
+		t.Errorf("Request for another key was not allowed")
+	}
+
+	// Tokens refill at the configured rate
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.Allow("a") {
+		t.Errorf("Request after refill was not allowed")
+	}
+	if limiter.Allow("a") {
+		t.Errorf("Request past the refill was allowed")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := newRateLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if !limiter.Allow("a") {
+			t.Fatalf("Request %d was not allowed", i+1)
+		}
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(1, 1)
+	limiter.now = func() time.Time { return now }
+	limiter.lastPrune = now
+
+	limiter.Allow("a")
+	now = now.Add(rateLimiterPruneInterval)
+	limiter.Allow("b")
+
+	if _, exists := limiter.buckets["a"]; exists {
+		t.Errorf("Idle bucket was not pruned")
+	}
+	if _, exists := limiter.buckets["b"]; !exists {
+		t.Errorf("Active bucket was pruned")
+	}
+}
@@ -0,0 +1,479 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AlexMax/charon/srp"
+)
+
+// Session store errors.
+var (
+	ErrSessionExists    = errors.New("session already exists")
+	ErrSessionNoExist   = errors.New("session does not exist")
+	ErrSessionStoreFull = errors.New("too many sessions in progress")
+	ErrSessionConflict  = errors.New("session was changed by another request")
+)
+
+// SessionState is how far along the SRP handshake a session is.
+type SessionState uint8
+
+// Session states, in the order a handshake passes through them.
+const (
+	SessionNegotiated SessionState = iota // Waiting for the client's ephemeral
+	SessionEphemeral                      // Waiting for the client's proof
+	SessionCompleted                      // Proof has been checked
+)
+
+// SessionReply is a request handled by a session along with the response
+// that was sent, so that a retransmitted request can be answered again
+// without touching the SRP state.
+type SessionReply struct {
+	Request  []byte
+	Response []byte
+}
+
+// NewSessionReply creates a SessionReply holding copies of a request and its
+// response.
+func NewSessionReply(request []byte, response []byte) SessionReply {
+	return SessionReply{
+		Request:  append([]byte(nil), request...),
+		Response: append([]byte(nil), response...),
+	}
+}
+
+// Matches returns true if the request has already been answered.
+func (reply SessionReply) Matches(request []byte) bool {
+	return reply.Response != nil && bytes.Equal(reply.Request, request)
+}
+
+// AuthSession contains the state of a single authentication attempt.
+type AuthSession struct {
+	ID      uint32
+	Address net.Addr // Game server that negotiated the session
+	State   SessionState
+	SRP     *srp.ServerSession
+	User    *User
+	Version uint8
+	Decoy   bool      // User does not exist, session must fail
+	Unsafe  bool      // User's verifier uses an untrusted group
+	Expires time.Time // Set by the store when the session is added
+
+	// Last response to each type of request.
+	EphemeralReply SessionReply
+	ProofReply     SessionReply
+
+	// Serializes handlers working on the same session.  Stores that hand
+	// out copies of a session do not need to care about it.
+	mutex sync.Mutex
+
+	// State of a copied session when it was loaded, so that a store can
+	// tell if another request has changed it since.
+	storedState SessionState
+}
+
+// SessionStore holds authentication sessions while they are in progress.
+// Sessions expire a fixed time after they are added.
+type SessionStore interface {
+	// Add stores a new session.  It fails with ErrSessionExists if the
+	// session ID is taken, or ErrSessionStoreFull if the store is full.
+	Add(ctx context.Context, session *AuthSession) error
+	// Get returns an unexpired session, or ErrSessionNoExist.
+	Get(ctx context.Context, id uint32) (*AuthSession, error)
+	// Update saves the state of a session returned by Get.  It fails with
+	// ErrSessionConflict if another request has changed the state of the
+	// session since.
+	Update(ctx context.Context, session *AuthSession) error
+	// Delete removes a session, if it exists.
+	Delete(ctx context.Context, id uint32) error
+	// Pending returns the number of unexpired sessions that have not been
+	// completed.
+	Pending(ctx context.Context) (int, error)
+	// Close stops any background work done by the store.
+	Close() error
+}
+
+// NewSessionStore creates the session store selected by the configuration.
+func NewSessionStore(config *Config, database Store, secret []byte) (store SessionStore, err error) {
+	switch config.Auth.SessionStore {
+	case "memory":
+		store = NewMemorySessionStore(config.Auth.SessionTTL, config.Auth.MaxSessions)
+	case "database":
+		store = NewDatabaseSessionStore(database, sessionKey(secret), config.Auth.SessionTTL, config.Auth.MaxSessions)
+	default:
+		err = fmt.Errorf("unknown session store \"%s\"", config.Auth.SessionStore)
+	}
+	return
+}
+
+// memorySessionExpiry is an entry in the expiry queue of a
+// MemorySessionStore.
+type memorySessionExpiry struct {
+	session *AuthSession
+	expires time.Time
+}
+
+// MemorySessionStore keeps sessions in memory.  Since every session lives
+// for the same amount of time, sessions expire in the order they were added
+// and a single queue is enough to find the ones that have expired.
+type MemorySessionStore struct {
+	ttl      time.Duration
+	max      int
+	sessions map[uint32]*AuthSession
+	queue    []memorySessionExpiry
+	mutex    sync.Mutex
+	now      func() time.Time
+	done     chan struct{}
+	closed   sync.Once
+}
+
+// NewMemorySessionStore creates a new in-memory session store.  A max of 0
+// places no limit on the number of sessions.
+func NewMemorySessionStore(ttl time.Duration, max int) (store *MemorySessionStore) {
+	store = new(MemorySessionStore)
+	store.ttl = ttl
+	store.max = max
+	store.sessions = make(map[uint32]*AuthSession)
+	store.now = time.Now
+	store.done = make(chan struct{})
+
+	go store.janitor()
+	return
+}
+
+// janitor periodically frees expired sessions.
+func (store *MemorySessionStore) janitor() {
+	ticker := time.NewTicker(store.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			store.mutex.Lock()
+			store.expire()
+			store.mutex.Unlock()
+		case <-store.done:
+			return
+		}
+	}
+}
+
+// expire removes expired sessions from the front of the queue.  The mutex
+// must be held.
+func (store *MemorySessionStore) expire() {
+	now := store.now()
+	for len(store.queue) > 0 && !store.queue[0].expires.After(now) {
+		entry := store.queue[0]
+		store.queue[0] = memorySessionExpiry{}
+		store.queue = store.queue[1:]
+
+		// The session might have been deleted and its ID reused.
+		if store.sessions[entry.session.ID] == entry.session {
+			delete(store.sessions, entry.session.ID)
+		}
+	}
+}
+
+// Add stores a new session.
+func (store *MemorySessionStore) Add(ctx context.Context, session *AuthSession) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.expire()
+	if _, exists := store.sessions[session.ID]; exists {
+		return ErrSessionExists
+	}
+	if store.max > 0 && len(store.sessions) >= store.max {
+		return ErrSessionStoreFull
+	}
+
+	session.Expires = store.now().Add(store.ttl)
+	store.sessions[session.ID] = session
+	store.queue = append(store.queue, memorySessionExpiry{session, session.Expires})
+	return nil
+}
+
+// Get returns an unexpired session.  The session is shared with other
+// callers, so it must be locked while in use.
+func (store *MemorySessionStore) Get(ctx context.Context, id uint32) (*AuthSession, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	session, exists := store.sessions[id]
+	if !exists || !session.Expires.After(store.now()) {
+		return nil, ErrSessionNoExist
+	}
+	return session, nil
+}
+
+// Update does nothing, as sessions are changed in place.
+func (store *MemorySessionStore) Update(ctx context.Context, session *AuthSession) error {
+	return nil
+}
+
+// Delete removes a session.
+func (store *MemorySessionStore) Delete(ctx context.Context, id uint32) error {
+	store.mutex.Lock()
+	delete(store.sessions, id)
+	store.mutex.Unlock()
+	return nil
+}
+
+// Pending returns the number of unexpired sessions that have not been
+// completed.
+func (store *MemorySessionStore) Pending(ctx context.Context) (count int, err error) {
+	// Handlers lock a session before the store, so the store must be
+	// unlocked before looking inside sessions.
+	store.mutex.Lock()
+	store.expire()
+	sessions := make([]*AuthSession, 0, len(store.sessions))
+	for _, session := range store.sessions {
+		sessions = append(sessions, session)
+	}
+	store.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.mutex.Lock()
+		if session.State != SessionCompleted {
+			count++
+		}
+		session.mutex.Unlock()
+	}
+	return
+}
+
+// Close stops the janitor.
+func (store *MemorySessionStore) Close() error {
+	store.closed.Do(func() {
+		close(store.done)
+	})
+	return nil
+}
+
+// sessionKey derives the key that encrypts SRP state in the database from
+// the auth secret.
+func sessionKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("session"))
+	return mac.Sum(nil)
+}
+
+// DatabaseSessionStore keeps sessions in the database, so several instances
+// of the auth server sharing a database can pick up each other's sessions.
+// Every instance must use the same auth secret.
+type DatabaseSessionStore struct {
+	database Store
+	key      []byte
+	ttl      time.Duration
+	max      int
+	now      func() time.Time
+	done     chan struct{}
+	closed   sync.Once
+}
+
+// NewDatabaseSessionStore creates a new session store backed by the
+// database.  SRP state is encrypted with key before it is stored.  A max of
+// 0 places no limit on the number of sessions.
+func NewDatabaseSessionStore(database Store, key []byte, ttl time.Duration, max int) (store *DatabaseSessionStore) {
+	store = new(DatabaseSessionStore)
+	store.database = database
+	store.key = key
+	store.ttl = ttl
+	store.max = max
+	store.now = time.Now
+	store.done = make(chan struct{})
+
+	go store.janitor()
+	return
+}
+
+// janitor periodically deletes expired sessions.
+func (store *DatabaseSessionStore) janitor() {
+	ticker := time.NewTicker(store.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := store.database.DeleteExpiredSessions(context.Background(), store.now())
+			if err != nil {
+				log.Printf("[ERROR] %s", err.Error())
+			}
+		case <-store.done:
+			return
+		}
+	}
+}
+
+// Add stores a new session.
+func (store *DatabaseSessionStore) Add(ctx context.Context, session *AuthSession) (err error) {
+	srpData, err := store.marshalSRP(session)
+	if err != nil {
+		return
+	}
+
+	now := store.now()
+	session.Expires = now.Add(store.ttl)
+	record := &SessionRecord{
+		ID:       session.ID,
+		Network:  session.Address.Network(),
+		Address:  session.Address.String(),
+		State:    session.State,
+		SRP:      srpData,
+		UserID:   session.User.ID,
+		Username: session.User.Username,
+		Access:   session.User.Access,
+		SRPGroup: session.User.SRPGroup,
+		SRPHash:  session.User.SRPHash,
+		Version:  session.Version,
+		Decoy:    session.Decoy,
+		Unsafe:   session.Unsafe,
+		Expires:  session.Expires.UnixNano(),
+	}
+
+	return store.database.AddSession(ctx, record, now, store.max)
+}
+
+// Get returns a copy of an unexpired session.
+func (store *DatabaseSessionStore) Get(ctx context.Context, id uint32) (session *AuthSession, err error) {
+	record, err := store.database.FindSession(ctx, id, store.now())
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNoExist
+	} else if err != nil {
+		return
+	}
+
+	address, err := resolveAddress(record.Network, record.Address)
+	if err != nil {
+		return
+	}
+
+	// The server side never derives x, so the key derivation doesn't matter.
+	srpo, err := NewSRP(record.SRPGroup, record.SRPHash, LegacyKDF)
+	if err != nil {
+		return
+	}
+	srpo.MarshalKey = store.key
+	srpSession := &srp.ServerSession{SRP: srpo}
+	err = srpSession.UnmarshalBinary(record.SRP)
+	if err != nil {
+		return
+	}
+
+	session = &AuthSession{
+		ID:      record.ID,
+		Address: address,
+		State:   record.State,
+		SRP:     srpSession,
+		User: &User{
+			ID:       record.UserID,
+			Username: record.Username,
+			Access:   record.Access,
+			SRPGroup: record.SRPGroup,
+			SRPHash:  record.SRPHash,
+		},
+		Version: record.Version,
+		Decoy:   record.Decoy,
+		Unsafe:  record.Unsafe,
+		Expires: time.Unix(0, record.Expires),
+		EphemeralReply: SessionReply{
+			Request:  record.EphemeralRequest,
+			Response: record.EphemeralResponse,
+		},
+		ProofReply: SessionReply{
+			Request:  record.ProofRequest,
+			Response: record.ProofResponse,
+		},
+		storedState: record.State,
+	}
+	return
+}
+
+// marshalSRP encrypts the SRP state of a session with the store's key.
+func (store *DatabaseSessionStore) marshalSRP(session *AuthSession) ([]byte, error) {
+	session.SRP.SRP.MarshalKey = store.key
+	return session.SRP.MarshalBinary()
+}
+
+// Update saves the handshake state of a session, as long as no other request
+// has changed its state since it was loaded.
+func (store *DatabaseSessionStore) Update(ctx context.Context, session *AuthSession) (err error) {
+	srpData, err := store.marshalSRP(session)
+	if err != nil {
+		return
+	}
+
+	record := &SessionRecord{
+		ID:                session.ID,
+		State:             session.State,
+		SRP:               srpData,
+		EphemeralRequest:  session.EphemeralReply.Request,
+		EphemeralResponse: session.EphemeralReply.Response,
+		ProofRequest:      session.ProofReply.Request,
+		ProofResponse:     session.ProofReply.Response,
+	}
+
+	err = store.database.UpdateSession(ctx, record, session.storedState, store.now())
+	if err == sql.ErrNoRows {
+		return ErrSessionNoExist
+	} else if err != nil {
+		return
+	}
+	session.storedState = session.State
+	return
+}
+
+// Delete removes a session.
+func (store *DatabaseSessionStore) Delete(ctx context.Context, id uint32) error {
+	return store.database.DeleteSession(ctx, id)
+}
+
+// Pending returns the number of unexpired sessions that have not been
+// completed.
+func (store *DatabaseSessionStore) Pending(ctx context.Context) (int, error) {
+	return store.database.PendingSessions(ctx, store.now())
+}
+
+// Close stops the janitor.
+func (store *DatabaseSessionStore) Close() error {
+	store.closed.Do(func() {
+		close(store.done)
+	})
+	return nil
+}
+
+// resolveAddress turns a stored address back into a net.Addr.
+func resolveAddress(network string, address string) (net.Addr, error) {
+	switch network {
+	case "udp":
+		return net.ResolveUDPAddr(network, address)
+	case "tcp":
+		return net.ResolveTCPAddr(network, address)
+	}
+	return nil, fmt.Errorf("unknown network \"%s\"", network)
+}
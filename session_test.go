@@ -0,0 +1,342 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AlexMax/charon/srp"
+)
+
+func newTestSession(t *testing.T, id uint32) *AuthSession {
+	srpo, err := srp.NewSRP("rfc5054.2048", sha256.New, nil)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	salt, verifier, err := srpo.ComputeVerifier([]byte("username"), []byte("password"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+
+	return &AuthSession{
+		ID:      id,
+		Address: addr,
+		SRP:     srpo.NewServerSession([]byte("username"), salt, verifier),
+		User: &User{
+			ID:       1,
+			Username: "username",
+			Access:   UserAccessUser,
+			SRPGroup: LegacySRPGroup,
+			SRPHash:  LegacySRPHash,
+		},
+		Version: ProtocolVersion,
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	store := NewMemorySessionStore(time.Minute, 2)
+	defer store.Close()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	err := store.Add(context.Background(), newTestSession(t, 1))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = store.Add(context.Background(), newTestSession(t, 1))
+	if err != ErrSessionExists {
+		t.Errorf("Duplicate session returned %v instead of %v", err, ErrSessionExists)
+	}
+	err = store.Add(context.Background(), newTestSession(t, 2))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = store.Add(context.Background(), newTestSession(t, 3))
+	if err != ErrSessionStoreFull {
+		t.Errorf("Session past the maximum returned %v instead of %v", err, ErrSessionStoreFull)
+	}
+
+	// A deleted session ID can be reused, and the new session must not
+	// expire along with the old one.
+	store.Delete(context.Background(), 1)
+	now = now.Add(30 * time.Second)
+	err = store.Add(context.Background(), newTestSession(t, 1))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	now = now.Add(30 * time.Second)
+	_, err = store.Get(context.Background(), 2)
+	if err != ErrSessionNoExist {
+		t.Errorf("Expired session returned %v instead of %v", err, ErrSessionNoExist)
+	}
+	_, err = store.Get(context.Background(), 1)
+	if err != nil {
+		t.Errorf("Reused session was expired early (%v)", err)
+	}
+	count, _ := store.Pending(context.Background())
+	if count != 1 {
+		t.Errorf("Store contains %d sessions instead of 1", count)
+	}
+}
+
+func TestDatabaseSessionStore(t *testing.T) {
+	database, err := NewDatabase(NewConfig(nil))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	store := NewDatabaseSessionStore(database, sessionKey([]byte("secret")), time.Minute, 2)
+	defer store.Close()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	session := newTestSession(t, 1)
+	err = store.Add(context.Background(), session)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = store.Add(context.Background(), newTestSession(t, 1))
+	if err != ErrSessionExists {
+		t.Errorf("Duplicate session returned %v instead of %v", err, ErrSessionExists)
+	}
+	err = store.Add(context.Background(), newTestSession(t, 2))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	err = store.Add(context.Background(), newTestSession(t, 3))
+	if err != ErrSessionStoreFull {
+		t.Errorf("Session past the maximum returned %v instead of %v", err, ErrSessionStoreFull)
+	}
+
+	restored, err := store.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if string(restored.SRP.GetB()) != string(session.SRP.GetB()) {
+		t.Errorf("Session SRP state was not restored")
+	}
+	if restored.Address.String() != session.Address.String() {
+		t.Errorf("Session address is %v instead of %v", restored.Address, session.Address)
+	}
+	if restored.User.Username != "username" || restored.User.Access != UserAccessUser {
+		t.Errorf("Session user was not restored (%v)", restored.User)
+	}
+
+	// Only the first of two requests working on the same session can move
+	// it along.
+	stale, err := store.Get(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	restored.State = SessionEphemeral
+	err = store.Update(context.Background(), restored)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	stale.State = SessionEphemeral
+	err = store.Update(context.Background(), stale)
+	if err != ErrSessionConflict {
+		t.Errorf("Stale session update returned %v instead of %v", err, ErrSessionConflict)
+	}
+	restored.State = SessionCompleted
+	err = store.Update(context.Background(), restored)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+
+	// SRP state can't be restored without the same secret.
+	other := NewDatabaseSessionStore(database, sessionKey([]byte("other")), time.Minute, 2)
+	defer other.Close()
+	other.now = store.now
+	_, err = other.Get(context.Background(), 1)
+	if err == nil {
+		t.Errorf("Session was restored with a different secret")
+	}
+
+	now = now.Add(time.Minute)
+	_, err = store.Get(context.Background(), 1)
+	if err != ErrSessionNoExist {
+		t.Errorf("Expired session returned %v instead of %v", err, ErrSessionNoExist)
+	}
+	err = store.Add(context.Background(), newTestSession(t, 1))
+	if err != nil {
+		t.Errorf("Expired session ID could not be reused (%v)", err)
+	}
+}
+
+// Sessions kept in the database can't be shared without a common secret.
+func TestDatabaseSessionStoreSecret(t *testing.T) {
+	config := NewConfig(nil)
+	config.Auth.SessionStore = "database"
+	_, err := NewAuthApp(config, newTestDatabase(t, config))
+	if err == nil {
+		t.Errorf("Auth app was created without a secret")
+	}
+
+	config.Auth.Secret = "a long and random secret"
+	_, err = NewAuthApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+}
+
+// newSharedAuthApps creates two auth servers that share a database
+// containing a single user.
+func newSharedAuthApps(t *testing.T) (first *AuthApp, second *AuthApp) {
+	config := NewConfig(nil)
+	config.Auth.Secret = "a long and random secret"
+	config.Auth.SessionStore = "database"
+	config.Database.Filename = filepath.Join(t.TempDir(), "charon.db")
+
+	first, _ = newTestAuthApp(t, config, UserAccessUser)
+	second, err := NewAuthApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return
+}
+
+// Two auth servers sharing a database can finish each other's sessions.
+func TestHandshakeSharedSessions(t *testing.T) {
+	first, second := newSharedAuthApps(t)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+
+	negotiate := ServerNegotiate{Version: ProtocolVersion, ClientSession: 1234, Username: "username"}
+	message, _ := negotiate.MarshalBinary()
+	message = routeMessage(t, first, addr, message)
+	var authNegotiate AuthNegotiate
+	err := authNegotiate.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("AuthNegotiate did not unmarshall correctly (%v)", err)
+	}
+
+	srpo, _ := srp.NewSRP("rfc5054.2048", sha256.New, nil)
+	cs := srpo.NewClientSession([]byte(authNegotiate.Username), []byte("password"))
+	ephemeral := ServerEphemeral{Session: authNegotiate.Session, Ephemeral: cs.GetA()}
+	message, _ = ephemeral.MarshalBinary()
+	message = routeMessage(t, second, addr, message)
+	var authEphemeral AuthEphemeral
+	err = authEphemeral.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("AuthEphemeral did not unmarshall correctly (%v)", err)
+	}
+
+	_, err = cs.ComputeKey(authNegotiate.Salt, authEphemeral.Ephemeral)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	proof := ServerProof{Session: authNegotiate.Session, Proof: cs.ComputeAuthenticator()}
+	message, _ = proof.MarshalBinary()
+	message = routeMessage(t, first, addr, message)
+	var authProof AuthProof
+	err = authProof.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+	}
+	if !cs.VerifyServerAuthenticator(authProof.Proof) {
+		t.Errorf("Server proof is not valid")
+	}
+}
+
+// racingSessionStore lets another request through just before a session is
+// updated.
+type racingSessionStore struct {
+	SessionStore
+	race func()
+}
+
+func (store *racingSessionStore) Update(ctx context.Context, session *AuthSession) error {
+	if store.race != nil {
+		store.race()
+		store.race = nil
+	}
+	return store.SessionStore.Update(ctx, session)
+}
+
+// A request that loses a race to another auth server is answered the same
+// way, or dropped if it was a different request.
+func TestHandshakeSessionConflict(t *testing.T) {
+	first, second := newSharedAuthApps(t)
+	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:16667")
+
+	negotiate := ServerNegotiate{Version: ProtocolVersion, ClientSession: 1234, Username: "username"}
+	message, _ := negotiate.MarshalBinary()
+	message = routeMessage(t, first, addr, message)
+	var authNegotiate AuthNegotiate
+	err := authNegotiate.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("AuthNegotiate did not unmarshall correctly (%v)", err)
+	}
+
+	srpo, _ := srp.NewSRP("rfc5054.2048", sha256.New, nil)
+	cs := srpo.NewClientSession([]byte(authNegotiate.Username), []byte("password"))
+	ephemeral := ServerEphemeral{Session: authNegotiate.Session, Ephemeral: cs.GetA()}
+	ephemeralRequest, _ := ephemeral.MarshalBinary()
+
+	var firstResponse []byte
+	second.sessions = &racingSessionStore{second.sessions, func() {
+		firstResponse = routeMessage(t, first, addr, ephemeralRequest)
+	}}
+	secondResponse := routeMessage(t, second, addr, ephemeralRequest)
+	if !bytes.Equal(firstResponse, secondResponse) {
+		t.Errorf("Racing ephemeral requests were answered differently")
+	}
+
+	// The SRP state of the winner is kept.
+	var authEphemeral AuthEphemeral
+	err = authEphemeral.UnmarshalBinary(secondResponse)
+	if err != nil {
+		t.Fatalf("AuthEphemeral did not unmarshall correctly (%v)", err)
+	}
+	_, err = cs.ComputeKey(authNegotiate.Salt, authEphemeral.Ephemeral)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	proof := ServerProof{Session: authNegotiate.Session, Proof: cs.ComputeAuthenticator()}
+	proofRequest, _ := proof.MarshalBinary()
+
+	// A different proof that loses the race gets no answer.
+	wrong := ServerProof{Session: authNegotiate.Session, Proof: make([]byte, len(proof.Proof))}
+	wrongRequest, _ := wrong.MarshalBinary()
+	second.sessions = &racingSessionStore{second.sessions, func() {
+		routeMessage(t, first, addr, proofRequest)
+	}}
+	_, err = second.handleProof(context.Background(), &request{addr, wrongRequest})
+	if err == nil {
+		t.Errorf("Proof that lost a race was answered")
+	}
+
+	message = routeMessage(t, first, addr, proofRequest)
+	var authProof AuthProof
+	err = authProof.UnmarshalBinary(message)
+	if err != nil {
+		t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+	}
+	if !cs.VerifyServerAuthenticator(authProof.Proof) {
+		t.Errorf("Server proof is not valid")
+	}
+}
@@ -0,0 +1,69 @@
+//go:build cgo
+
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3" // Database driver
+)
+
+func init() {
+	dialects["sqlite3"] = &dialect{
+		driver:  "sqlite3",
+		connect: connectSQLite,
+		types:   strings.NewReplacer(),
+		columns: "SELECT name FROM pragma_table_info(?)",
+	}
+}
+
+// connectSQLite opens a database file.  Pragmas only apply to the
+// connection they are run on, so they are passed to the driver to run on
+// every connection in the pool.
+func connectSQLite(config *Config) (db *sqlx.DB, err error) {
+	params := url.Values{}
+	params.Set("_foreign_keys", "1")
+	params.Set("_busy_timeout", fmt.Sprintf("%d", config.Database.BusyTimeout.Milliseconds()))
+	params.Set("_journal_mode", config.Database.JournalMode)
+	// Take the write lock up front, so transactions that read before they
+	// write wait for the busy timeout instead of failing.
+	params.Set("_txlock", "immediate")
+
+	filename := config.Database.Filename
+	separator := "?"
+	if strings.Contains(filename, "?") {
+		separator = "&"
+	}
+
+	db, err = sqlx.Connect("sqlite3", filename+separator+params.Encode())
+	if err != nil {
+		return
+	}
+
+	// Every connection to an in-memory database gets a database of its own.
+	if strings.Contains(filename, ":memory:") {
+		db.SetMaxOpenConns(1)
+	}
+	return
+}
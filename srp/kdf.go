@@ -0,0 +1,73 @@
+// Copyright 2016 Alex Mayfield <alexmax2742@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package srp
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDFKeyLength is the size in bytes of x as derived by the memory-hard key
+// derivation functions.
+const KDFKeyLength = 32
+
+// identity joins a username and password the same way RFC 2945 does, so the
+// username stays bound to the derived key.
+func identity(username []byte, password []byte) []byte {
+	icp := make([]byte, 0, len(username)+1+len(password))
+	icp = append(icp, username...)
+	icp = append(icp, ':')
+	return append(icp, password...)
+}
+
+// ScryptKDF returns a KeyDerivationFunc that derives x using scrypt with the
+// given cost parameters.
+func ScryptKDF(N int, r int, p int) (KeyDerivationFunc, error) {
+	if N <= 1 || N&(N-1) != 0 {
+		return nil, errors.New("scrypt: N must be > 1 and a power of 2")
+	}
+	if r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 || N > (1<<31-1)/128/r {
+		return nil, errors.New("scrypt: parameters are invalid")
+	}
+
+	return func(salt []byte, username []byte, password []byte) []byte {
+		x, err := scrypt.Key(identity(username, password), salt, N, r, p, KDFKeyLength)
+		if err != nil {
+			// Parameters were checked above.
+			panic(err)
+		}
+		return x
+	}, nil
+}
+
+// Argon2idKDF returns a KeyDerivationFunc that derives x using Argon2id with
+// the given number of passes, memory in KiB and degree of parallelism.
+func Argon2idKDF(time uint32, memory uint32, threads uint8) (KeyDerivationFunc, error) {
+	if time < 1 {
+		return nil, errors.New("argon2id: time must be at least 1")
+	}
+	if threads < 1 {
+		return nil, errors.New("argon2id: threads must be at least 1")
+	}
+	if memory < 8*uint32(threads) {
+		return nil, errors.New("argon2id: memory must be at least 8 KiB per thread")
+	}
+
+	return func(salt []byte, username []byte, password []byte) []byte {
+		return argon2.IDKey(identity(username, password), salt, time, memory, threads, KDFKeyLength)
+	}, nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Alex Mayfield <alexmax2742@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package srp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func testKDF(t *testing.T, kd KeyDerivationFunc) {
+	salt := []byte("saltsaltsaltsalt")
+	x := kd(salt, []byte("test"), []byte("password"))
+	if len(x) != KDFKeyLength {
+		t.Errorf("Derived key is %d bytes instead of %d", len(x), KDFKeyLength)
+	}
+	if !bytes.Equal(x, kd(salt, []byte("test"), []byte("password"))) {
+		t.Errorf("Key derivation is not deterministic")
+	}
+	if bytes.Equal(x, kd(salt, []byte("tes"), []byte("tpassword"))) {
+		t.Errorf("Username and password are not kept apart")
+	}
+
+	srp, err := NewSRP("rfc5054.2048", sha256.New, kd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, v, err := srp.ComputeVerifier([]byte("test"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, password := range []string{"password", "wrong"} {
+		cs := srp.NewClientSession([]byte("test"), []byte(password))
+		ss := srp.NewServerSession([]byte("test"), salt, v)
+		_, err = cs.ComputeKey(salt, ss.GetB())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ss.ComputeKey(cs.GetA())
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid := ss.VerifyClientAuthenticator(cs.ComputeAuthenticator())
+		if valid != (password == "password") {
+			t.Errorf("Client Authenticator validity is %v for %s", valid, password)
+		}
+	}
+}
+
+func TestScryptKDF(t *testing.T) {
+	kd, err := ScryptKDF(1024, 8, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKDF(t, kd)
+
+	for _, params := range [][3]int{{0, 8, 1}, {1000, 8, 1}, {1024, 0, 1}, {1024, 8, 0}} {
+		_, err = ScryptKDF(params[0], params[1], params[2])
+		if err == nil {
+			t.Errorf("Scrypt parameters %v were accepted", params)
+		}
+	}
+}
+
+func TestArgon2idKDF(t *testing.T) {
+	kd, err := Argon2idKDF(1, 64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testKDF(t, kd)
+
+	_, err = Argon2idKDF(0, 64, 1)
+	if err == nil {
+		t.Errorf("Argon2id with no passes was accepted")
+	}
+	_, err = Argon2idKDF(1, 64, 0)
+	if err == nil {
+		t.Errorf("Argon2id with no threads was accepted")
+	}
+	_, err = Argon2idKDF(1, 7, 1)
+	if err == nil {
+		t.Errorf("Argon2id with too little memory was accepted")
+	}
+}
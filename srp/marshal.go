@@ -0,0 +1,301 @@
+// Copyright 2016 Alex Mayfield <alexmax2742@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package srp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// Marshalled sessions start with a plaintext header that is authenticated
+// along with the encrypted fields:
+//
+//	version (1) | side (1) | stage (1) | SHA-256 of N and g (32) |
+//	length-prefixed H("srp") | nonce (12)
+const marshalVersion = 1
+
+// Which side of the handshake a marshalled session belongs to.
+const (
+	marshalServer byte = 'S'
+	marshalClient byte = 'C'
+)
+
+// How far along the handshake a marshalled session is.
+const (
+	stageCreated       byte = iota // Ephemeral value generated
+	stageKey                       // Session key computed
+	stageAuthenticator             // Client authenticator computed
+)
+
+func writeField(buffer *bytes.Buffer, field []byte) {
+	binary.Write(buffer, binary.LittleEndian, uint32(len(field)))
+	buffer.Write(field)
+}
+
+func readField(buffer *bytes.Buffer) ([]byte, error) {
+	var length uint32
+	err := binary.Read(buffer, binary.LittleEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	if int(length) > buffer.Len() {
+		return nil, fmt.Errorf("Field length %d exceeds remaining data", length)
+	}
+	return buffer.Next(int(length)), nil
+}
+
+func readFields(buffer *bytes.Buffer, fields [][]byte) error {
+	for i := range fields {
+		field, err := readField(buffer)
+		if err != nil {
+			return err
+		}
+		fields[i] = append([]byte(nil), field...)
+	}
+	if buffer.Len() != 0 {
+		return fmt.Errorf("%d bytes of trailing data", buffer.Len())
+	}
+	return nil
+}
+
+func intBytes(n *big.Int) []byte {
+	if n == nil {
+		return nil
+	}
+	return n.Bytes()
+}
+
+// groupID identifies the group of an SRP context.
+func (s *SRP) groupID() []byte {
+	h := sha256.New()
+	h.Write(s.Group.Prime.Bytes())
+	h.Write([]byte{0})
+	h.Write(s.Group.Generator.Bytes())
+	return h.Sum(nil)
+}
+
+// hashID identifies the hash function of an SRP context by its output.
+func (s *SRP) hashID() []byte {
+	return quickHash(s.HashFunc, []byte("srp"))
+}
+
+func (s *SRP) aead() (cipher.AEAD, error) {
+	if s.MarshalKey == nil {
+		return nil, fmt.Errorf("SRP context has no MarshalKey")
+	}
+	block, err := aes.NewCipher(s.MarshalKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the fields of a session along with a header that describes
+// it.
+func (s *SRP) seal(side byte, stage byte, fields ...[]byte) ([]byte, error) {
+	aead, err := s.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.Write([]byte{marshalVersion, side, stage})
+	header.Write(s.groupID())
+	writeField(&header, s.hashID())
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(s.Rand, nonce)
+	if err != nil {
+		return nil, err
+	}
+	header.Write(nonce)
+
+	var plaintext bytes.Buffer
+	for _, field := range fields {
+		writeField(&plaintext, field)
+	}
+
+	data := header.Bytes()
+	return aead.Seal(data, nonce, plaintext.Bytes(), data), nil
+}
+
+// open checks the header of a marshalled session against the SRP context
+// and decrypts its fields.
+func (s *SRP) open(side byte, data []byte) (stage byte, plaintext *bytes.Buffer, err error) {
+	aead, err := s.aead()
+	if err != nil {
+		return
+	}
+
+	buffer := bytes.NewBuffer(data)
+	header := buffer.Next(3)
+	if len(header) != 3 || header[0] != marshalVersion {
+		err = fmt.Errorf("Unknown session encoding")
+		return
+	}
+	if header[1] != side {
+		err = fmt.Errorf("Session belongs to the other side of the handshake")
+		return
+	}
+	stage = header[2]
+
+	groupID := buffer.Next(sha256.Size)
+	if subtle.ConstantTimeCompare(groupID, s.groupID()) != 1 {
+		err = fmt.Errorf("Session uses a different group")
+		return
+	}
+	hashID, err := readField(buffer)
+	if err != nil {
+		return
+	}
+	if subtle.ConstantTimeCompare(hashID, s.hashID()) != 1 {
+		err = fmt.Errorf("Session uses a different hash")
+		return
+	}
+
+	nonce := buffer.Next(aead.NonceSize())
+	if len(nonce) != aead.NonceSize() {
+		err = fmt.Errorf("Session is truncated")
+		return
+	}
+
+	ad := data[:len(data)-buffer.Len()]
+	decrypted, err := aead.Open(nil, nonce, buffer.Bytes(), ad)
+	if err != nil {
+		return
+	}
+	plaintext = bytes.NewBuffer(decrypted)
+	return
+}
+
+// MarshalBinary encodes the state of a ServerSession so that it can be
+// restored later with UnmarshalBinary.  Everything but the group, hash and
+// stage is encrypted with SRP.MarshalKey.
+func (ss *ServerSession) MarshalBinary() ([]byte, error) {
+	stage := stageCreated
+	if ss.key != nil {
+		stage = stageKey
+	}
+	return ss.SRP.seal(marshalServer, stage,
+		ss.username, ss.salt, ss.verifier,
+		intBytes(ss._b), intBytes(ss._B), intBytes(ss._A), ss.key)
+}
+
+// UnmarshalBinary restores the state of a ServerSession encoded with
+// MarshalBinary.  The SRP field must already be set to an SRP context that
+// uses the same group, hash and MarshalKey as the original session.
+func (ss *ServerSession) UnmarshalBinary(data []byte) error {
+	if ss.SRP == nil {
+		return fmt.Errorf("ServerSession has no SRP context")
+	}
+
+	stage, plaintext, err := ss.SRP.open(marshalServer, data)
+	if err != nil {
+		return err
+	}
+	if stage > stageKey {
+		return fmt.Errorf("Unknown ServerSession stage %d", stage)
+	}
+	fields := make([][]byte, 7)
+	err = readFields(plaintext, fields)
+	if err != nil {
+		return err
+	}
+
+	ss.username = fields[0]
+	ss.salt = fields[1]
+	ss.verifier = fields[2]
+	ss._v = new(big.Int).SetBytes(ss.verifier)
+	ss._b = new(big.Int).SetBytes(fields[3])
+	ss._B = new(big.Int).SetBytes(fields[4])
+	ss._A = nil
+	ss._u = nil
+	ss.key = nil
+	if stage >= stageKey {
+		ss._A = new(big.Int).SetBytes(fields[5])
+		ss._u = ss.SRP.compute_u(ss._A, ss._B)
+		ss.key = fields[6]
+	}
+	return nil
+}
+
+// MarshalBinary encodes the state of a ClientSession so that it can be
+// restored later with UnmarshalBinary.  Everything but the group, hash and
+// stage is encrypted with SRP.MarshalKey.  Until the key has been computed
+// this includes the password.
+func (cs *ClientSession) MarshalBinary() ([]byte, error) {
+	stage := stageCreated
+	if cs._M != nil {
+		stage = stageAuthenticator
+	} else if cs.key != nil {
+		stage = stageKey
+	}
+	password := cs.password
+	if stage >= stageKey {
+		password = nil
+	}
+	return cs.SRP.seal(marshalClient, stage,
+		cs.username, password, cs.salt,
+		intBytes(cs._a), intBytes(cs._A), intBytes(cs._B), cs.key, cs._M)
+}
+
+// UnmarshalBinary restores the state of a ClientSession encoded with
+// MarshalBinary.  The SRP field must already be set to an SRP context that
+// uses the same group, hash and MarshalKey as the original session.
+func (cs *ClientSession) UnmarshalBinary(data []byte) error {
+	if cs.SRP == nil {
+		return fmt.Errorf("ClientSession has no SRP context")
+	}
+
+	stage, plaintext, err := cs.SRP.open(marshalClient, data)
+	if err != nil {
+		return err
+	}
+	if stage > stageAuthenticator {
+		return fmt.Errorf("Unknown ClientSession stage %d", stage)
+	}
+	fields := make([][]byte, 8)
+	err = readFields(plaintext, fields)
+	if err != nil {
+		return err
+	}
+
+	cs.username = fields[0]
+	cs.password = fields[1]
+	cs.salt = nil
+	cs._a = new(big.Int).SetBytes(fields[3])
+	cs._A = new(big.Int).SetBytes(fields[4])
+	cs._B = nil
+	cs._u = nil
+	cs.key = nil
+	cs._M = nil
+	if stage >= stageKey {
+		cs.salt = fields[2]
+		cs._B = new(big.Int).SetBytes(fields[5])
+		cs._u = cs.SRP.compute_u(cs._A, cs._B)
+		cs.key = fields[6]
+	}
+	if stage >= stageAuthenticator {
+		cs._M = fields[7]
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2016 Alex Mayfield <alexmax2742@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package srp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+)
+
+var marshalKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestServerSessionMarshal(t *testing.T) {
+	username := []byte("test")
+	password := []byte("password")
+
+	srp, err := NewSRP("rfc5054.2048", sha256.New, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srp.MarshalKey = marshalKey
+	salt, v, err := srp.ComputeVerifier(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := srp.NewClientSession(username, password)
+	ss := srp.NewServerSession(username, salt, v)
+
+	// Restore the session before the key exchange...
+	data, err := ss.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &ServerSession{SRP: srp}
+	err = restored.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored.GetB(), ss.GetB()) {
+		t.Fatal("B was not restored")
+	}
+
+	ckey, err := cs.ComputeKey(salt, restored.GetB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = restored.ComputeKey(cs.GetA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ...and again after it.
+	data, err = restored.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored = &ServerSession{SRP: srp}
+	err = restored.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cauth := cs.ComputeAuthenticator()
+	if !restored.VerifyClientAuthenticator(cauth) {
+		t.Fatal("Client Authenticator is not valid")
+	}
+	if !cs.VerifyServerAuthenticator(restored.ComputeAuthenticator(cauth)) {
+		t.Fatal("Server Authenticator is not valid")
+	}
+	if !bytes.Equal(ckey, restored.key) {
+		t.Fatal("Keys don't match")
+	}
+}
+
+func TestClientSessionMarshal(t *testing.T) {
+	username := []byte("test")
+	password := []byte("password")
+
+	srp, err := NewSRP("rfc5054.2048", sha256.New, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srp.MarshalKey = marshalKey
+	salt, v, err := srp.ComputeVerifier(username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := srp.NewClientSession(username, password)
+	ss := srp.NewServerSession(username, salt, v)
+
+	// Restore the session before the key exchange...
+	data, err := cs.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, password) {
+		t.Fatal("Password was marshalled in the clear")
+	}
+	restored := &ClientSession{SRP: srp}
+	err = restored.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored.GetA(), cs.GetA()) {
+		t.Fatal("A was not restored")
+	}
+
+	_, err = restored.ComputeKey(salt, ss.GetB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	skey, err := ss.ComputeKey(restored.GetA())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ...after it...
+	data, err = restored.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored = &ClientSession{SRP: srp}
+	err = restored.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(skey, restored.GetKey()) {
+		t.Fatal("Keys don't match")
+	}
+	if len(restored.password) != 0 {
+		t.Fatal("Password was marshalled after the key exchange")
+	}
+
+	// ...and after the client authenticator.
+	cauth := restored.ComputeAuthenticator()
+	data, err = restored.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored = &ClientSession{SRP: srp}
+	err = restored.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ss.VerifyClientAuthenticator(cauth) {
+		t.Fatal("Client Authenticator is not valid")
+	}
+	if !restored.VerifyServerAuthenticator(ss.ComputeAuthenticator(cauth)) {
+		t.Fatal("Server Authenticator is not valid")
+	}
+}
+
+func TestServerSessionUnmarshalErrors(t *testing.T) {
+	srp, err := NewSRP("rfc5054.2048", sha256.New, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srp.MarshalKey = marshalKey
+	salt, v, err := srp.ComputeVerifier([]byte("test"), []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := srp.NewServerSession([]byte("test"), salt, v).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 1
+	stage := append([]byte(nil), data...)
+	stage[2] = stageKey
+
+	errors := [][]byte{
+		// Too short
+		[]byte("\x01S"),
+		// Truncated
+		data[:len(data)-20],
+		// Tampered ciphertext
+		tampered,
+		// Tampered header
+		stage,
+	}
+
+	for _, test := range errors {
+		ss := &ServerSession{SRP: srp}
+		if ss.UnmarshalBinary(test) == nil {
+			t.Errorf("%v was incorrectly parsed as valid", test)
+		}
+	}
+
+	ss := new(ServerSession)
+	if ss.UnmarshalBinary(data) == nil {
+		t.Errorf("Session without SRP context was incorrectly restored")
+	}
+
+	// Sessions can only be restored with a matching context.
+	contexts := map[string]func() (*SRP, error){
+		"wrong key": func() (*SRP, error) {
+			other, err := NewSRP("rfc5054.2048", sha256.New, nil)
+			if other != nil {
+				other.MarshalKey = []byte("fedcba9876543210fedcba9876543210")
+			}
+			return other, err
+		},
+		"no key": func() (*SRP, error) {
+			return NewSRP("rfc5054.2048", sha256.New, nil)
+		},
+		"wrong group": func() (*SRP, error) {
+			other, err := NewSRP("rfc5054.3072", sha256.New, nil)
+			if other != nil {
+				other.MarshalKey = marshalKey
+			}
+			return other, err
+		},
+		"wrong hash": func() (*SRP, error) {
+			other, err := NewSRP("rfc5054.2048", sha1.New, nil)
+			if other != nil {
+				other.MarshalKey = marshalKey
+			}
+			return other, err
+		},
+	}
+	for name, context := range contexts {
+		other, err := context()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss := &ServerSession{SRP: other}
+		if ss.UnmarshalBinary(data) == nil {
+			t.Errorf("Session was restored with %s", name)
+		}
+	}
+
+	// A server session is not a client session.
+	cs := &ClientSession{SRP: srp}
+	if cs.UnmarshalBinary(data) == nil {
+		t.Errorf("Server session was restored as a client session")
+	}
+}
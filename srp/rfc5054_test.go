@@ -0,0 +1,262 @@
+// Copyright 2016 Alex Mayfield <alexmax2742@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package srp
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// fromHex parses a value as printed in RFC 5054, ignoring whitespace.
+func fromHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func compareInt(t *testing.T, name string, expected *big.Int, actual *big.Int) {
+	if expected.Cmp(actual) != 0 {
+		t.Errorf("%s is %X instead of %X", name, actual, expected)
+	}
+}
+
+func compareBytes(t *testing.T, name string, expected []byte, actual []byte) {
+	if !bytes.Equal(expected, actual) {
+		t.Errorf("%s is %X instead of %X", name, actual, expected)
+	}
+}
+
+// vector is everything the protocol computes from one set of inputs.
+type vector struct {
+	k, x, v, A, B, u, S *big.Int
+	K, M1, M2           []byte
+}
+
+// computeVector works through SRP-6a as written in RFC 5054, independently
+// of the SRP type.
+func computeVector(hf HashFunc, grp *SRPGroup, I, P, s []byte, a, b *big.Int) (vec vector) {
+	N, g := grp.Prime, grp.Generator
+	pad := func(n *big.Int) []byte {
+		return append(make([]byte, (grp.Size+7)/8-len(n.Bytes())), n.Bytes()...)
+	}
+	H := func(parts ...[]byte) []byte {
+		h := hf()
+		for _, part := range parts {
+			h.Write(part)
+		}
+		return h.Sum(nil)
+	}
+	toInt := func(data []byte) *big.Int {
+		return new(big.Int).SetBytes(data)
+	}
+
+	// k = H(N | PAD(g)), x = H(s | H(I | ":" | P)), v = g^x % N
+	vec.k = toInt(H(N.Bytes(), pad(g)))
+	vec.x = toInt(H(s, H(I, []byte(":"), P)))
+	vec.v = new(big.Int).Exp(g, vec.x, N)
+
+	// A = g^a % N, B = (k * v + g^b) % N, u = H(PAD(A) | PAD(B))
+	vec.A = new(big.Int).Exp(g, a, N)
+	vec.B = new(big.Int).Mul(vec.k, vec.v)
+	vec.B.Add(vec.B, new(big.Int).Exp(g, b, N)).Mod(vec.B, N)
+	vec.u = toInt(H(pad(vec.A), pad(vec.B)))
+
+	// S = (A * v^u) ^ b % N
+	vec.S = new(big.Int).Exp(vec.v, vec.u, N)
+	vec.S.Mul(vec.S, vec.A).Mod(vec.S, N).Exp(vec.S, b, N)
+
+	// K = H(S), M1 = H(H(N) XOR H(g) | H(I) | s | A | B | K), M2 = H(A | M1 | K)
+	vec.K = H(vec.S.Bytes())
+	hng := new(big.Int).Xor(toInt(H(N.Bytes())), toInt(H(g.Bytes())))
+	vec.M1 = H(hng.Bytes(), H(I), s, vec.A.Bytes(), vec.B.Bytes(), vec.K)
+	vec.M2 = H(vec.A.Bytes(), vec.M1, vec.K)
+	return
+}
+
+// checkVector runs a handshake with randomness taken from the salt, a and b,
+// and compares every intermediate value against the expected vector.
+func checkVector(t *testing.T, srp *SRP, I, P, s, a, b []byte, vec vector) {
+	srp.SaltLength = len(s)
+	srp.ABSize = uint(len(a) * 8)
+	srp.Rand = bytes.NewReader(bytes.Join([][]byte{s, a, b}, nil))
+
+	salt, verifier, err := srp.ComputeVerifier(I, P)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareBytes(t, "s", s, salt)
+	compareInt(t, "k", vec.k, srp._k)
+	compareInt(t, "x", vec.x, new(big.Int).SetBytes(srp.KeyDerivationFunc(salt, I, P)))
+	compareInt(t, "v", vec.v, new(big.Int).SetBytes(verifier))
+
+	cs := srp.NewClientSession(I, P)
+	ss := srp.NewServerSession(I, salt, verifier)
+	compareInt(t, "A", vec.A, new(big.Int).SetBytes(cs.GetA()))
+	compareInt(t, "B", vec.B, new(big.Int).SetBytes(ss.GetB()))
+
+	ckey, err := cs.ComputeKey(salt, ss.GetB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	skey, err := ss.ComputeKey(cs.GetA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	compareInt(t, "Client u", vec.u, cs._u)
+	compareInt(t, "Server u", vec.u, ss._u)
+	compareBytes(t, "Client K", vec.K, ckey)
+	compareBytes(t, "Server K", vec.K, skey)
+
+	M1 := cs.ComputeAuthenticator()
+	compareBytes(t, "M1", vec.M1, M1)
+	if !ss.VerifyClientAuthenticator(M1) {
+		t.Errorf("Client Authenticator is not valid")
+	}
+	M2 := ss.ComputeAuthenticator(M1)
+	compareBytes(t, "M2", vec.M2, M2)
+	if !cs.VerifyServerAuthenticator(M2) {
+		t.Errorf("Server Authenticator is not valid")
+	}
+}
+
+// The test vectors from RFC 5054 Appendix B.  The RFC stops at the premaster
+// secret S, so K, M1 and M2 are derived from it as SRP-6a specifies.
+func TestRFC5054Vectors(t *testing.T) {
+	I := []byte("alice")
+	P := []byte("password123")
+	s := fromHex(t, "BEB25379 D1A8581E B5A72767 3A2441EE")
+	a := fromHex(t, `
+		60975527 035CF2AD 1989806F 0407210B C81EDC04 E2762A56 AFD529DD
+		DA2D4393`)
+	b := fromHex(t, `
+		E487CB59 D31AC550 471E81F0 0F6928E0 1DDA08E9 74A004F4 9E61F5D1
+		05284D20`)
+
+	srp, err := NewSRP("rfc5054.1024", sha1.New, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	published := vector{
+		k: new(big.Int).SetBytes(fromHex(t, "7556AA04 5AEF2CDD 07ABAF0F 665C3E81 8913186F")),
+		x: new(big.Int).SetBytes(fromHex(t, "94B7555A ABE9127C C58CCF49 93DB6CF8 4D16C124")),
+		v: new(big.Int).SetBytes(fromHex(t, `
+			7E273DE8 696FFC4F 4E337D05 B4B375BE B0DDE156 9E8FA00A 9886D812
+			9BADA1F1 822223CA 1A605B53 0E379BA4 729FDC59 F105B478 7E5186F5
+			C671085A 1447B52A 48CF1970 B4FB6F84 00BBF4CE BFBB1681 52E08AB5
+			EA53D15C 1AFF87B2 B9DA6E04 E058AD51 CC72BFC9 033B564E 26480D78
+			E955A5E2 9E7AB245 DB2BE315 E2099AFB`)),
+		A: new(big.Int).SetBytes(fromHex(t, `
+			61D5E490 F6F1B795 47B0704C 436F523D D0E560F0 C64115BB 72557EC4
+			4352E890 3211C046 92272D8B 2D1A5358 A2CF1B6E 0BFCF99F 921530EC
+			8E393561 79EAE45E 42BA92AE ACED8251 71E1E8B9 AF6D9C03 E1327F44
+			BE087EF0 6530E69F 66615261 EEF54073 CA11CF58 58F0EDFD FE15EFEA
+			B349EF5D 76988A36 72FAC47B 0769447B`)),
+		B: new(big.Int).SetBytes(fromHex(t, `
+			BD0C6151 2C692C0C B6D041FA 01BB152D 4916A1E7 7AF46AE1 05393011
+			BAF38964 DC46A067 0DD125B9 5A981652 236F99D9 B681CBF8 7837EC99
+			6C6DA044 53728610 D0C6DDB5 8B318885 D7D82C7F 8DEB75CE 7BD4FBAA
+			37089E6F 9C6059F3 88838E7A 00030B33 1EB76840 910440B1 B27AAEAE
+			EB4012B7 D7665238 A8E3FB00 4B117B58`)),
+		u: new(big.Int).SetBytes(fromHex(t, "CE38B959 3487DA98 554ED47D 70A7AE5F 462EF019")),
+		S: new(big.Int).SetBytes(fromHex(t, `
+			B0DC82BA BCF30674 AE450C02 87745E79 90A3381F 63B387AA F271A10D
+			233861E3 59B48220 F7C4693C 9AE12B0A 6F67809F 0876E2D0 13800D6C
+			41BB59B6 D5979B5C 00A172B4 A2A5903A 0BDCAF8A 709585EB 2AFAFA8F
+			3499B200 210DCC1F 10EB3394 3CD67FC8 8A2F39A4 BE5BEC4E C0A3212D
+			C346D7E4 74B29EDE 8A469FFE CA686E5A`)),
+	}
+
+	// Make sure the reference computation agrees with the RFC before
+	// trusting it for K, M1 and M2.
+	vec := computeVector(sha1.New, srp.Group, I, P, s, new(big.Int).SetBytes(a), new(big.Int).SetBytes(b))
+	compareInt(t, "Reference k", published.k, vec.k)
+	compareInt(t, "Reference x", published.x, vec.x)
+	compareInt(t, "Reference v", published.v, vec.v)
+	compareInt(t, "Reference A", published.A, vec.A)
+	compareInt(t, "Reference B", published.B, vec.B)
+	compareInt(t, "Reference u", published.u, vec.u)
+	compareInt(t, "Reference S", published.S, vec.S)
+
+	checkVector(t, srp, I, P, s, a, b, vec)
+}
+
+// deterministicReader is an endless stream of bytes that depends only on its
+// seed.
+type deterministicReader struct {
+	seed    string
+	counter uint64
+	buf     []byte
+}
+
+func (r *deterministicReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			h := sha256.New()
+			h.Write([]byte(r.seed))
+			binary.Write(h, binary.LittleEndian, r.counter)
+			r.counter++
+			r.buf = h.Sum(nil)
+		}
+		copied := copy(p[n:], r.buf)
+		r.buf = r.buf[copied:]
+		n += copied
+	}
+	return
+}
+
+// Every registered group, checked against the reference computation with
+// deterministic salts and ephemerals.
+func TestDeterministicVectors(t *testing.T) {
+	for _, g := range groups {
+		for _, h := range hashes {
+			srp, err := NewSRP(g, HashFunc(h), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rand := &deterministicReader{seed: g}
+			s := make([]byte, DefaultSaltLength)
+			a := make([]byte, DefaultABSize/8)
+			b := make([]byte, DefaultABSize/8)
+			rand.Read(s)
+			rand.Read(a)
+			rand.Read(b)
+
+			vec := computeVector(HashFunc(h), srp.Group, []byte("test"), []byte("password"), s, new(big.Int).SetBytes(a), new(big.Int).SetBytes(b))
+			checkVector(t, srp, []byte("test"), []byte("password"), s, a, b, vec)
+		}
+	}
+}
+
+func TestRandABSize(t *testing.T) {
+	srp, err := NewSRP("rfc5054.1024", sha1.New, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srp.ABSize = 12
+	srp.Rand = bytes.NewReader([]byte{0xFF, 0xFF})
+	if ab := srp.gen_rand_ab(); ab.Cmp(big.NewInt(0xFFF)) != 0 {
+		t.Errorf("a is %X instead of FFF", ab)
+	}
+}
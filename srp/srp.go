@@ -36,12 +36,15 @@ type KeyDerivationFunc func(salt []byte, username []byte, password []byte) []byt
 type HashFunc func() hash.Hash
 
 // SRP contains values that must be the the same for both the client and server.
-// SaltLength and ABSize are defaulted by NewSRP but can be changed after an SRP
-// instance is created.
-// Instances of SRP are safe for concurrent use.
+// SaltLength, ABSize and Rand are defaulted by NewSRP but can be changed after
+// an SRP instance is created.  MarshalKey must be set before sessions can be
+// marshalled.
+// Instances of SRP are safe for concurrent use if Rand is.
 type SRP struct {
-	SaltLength        int  // The size of the salt in bytes
-	ABSize            uint // The size of a and b in bits
+	SaltLength        int       // The size of the salt in bytes
+	ABSize            uint      // The size of a and b in bits
+	Rand              io.Reader // Source of salts and of a and b
+	MarshalKey        []byte    // AES key that encrypts marshalled sessions
 	HashFunc          HashFunc
 	KeyDerivationFunc KeyDerivationFunc
 	Group             *SRPGroup
@@ -104,8 +107,11 @@ func NewSRP(group string, h HashFunc, kd KeyDerivationFunc) (*SRP, error) {
 	srp := new(SRP)
 	srp.SaltLength = DefaultSaltLength
 	srp.ABSize = DefaultABSize
+	srp.Rand = rand.Reader
 	srp.HashFunc = h
+	srp_groups_mutex.RLock()
 	grp, ok := srp_groups[group]
+	srp_groups_mutex.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("Invalid Group: %s", group)
 	}
@@ -146,7 +152,7 @@ func quickHash(hf HashFunc, data []byte) []byte {
 func (s *SRP) ComputeVerifier(username []byte, password []byte) (salt []byte, verifier []byte, err error) {
 	//  x = H(s, p)               (s is chosen randomly)
 	salt = make([]byte, s.SaltLength)
-	n, err := io.ReadFull(rand.Reader, salt)
+	n, err := io.ReadFull(s.Rand, salt)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -385,12 +391,15 @@ func (s *SRP) compute_k() {
 }
 
 func (s *SRP) gen_rand_ab() *big.Int {
-	max := new(big.Int).Lsh(big.NewInt(1), s.ABSize)
-	r, err := rand.Int(rand.Reader, max)
+	// Read exactly ABSize bits so that a deterministic Rand gives a and b
+	// verbatim.
+	buf := make([]byte, (s.ABSize+7)/8)
+	_, err := io.ReadFull(s.Rand, buf)
 	if err != nil {
 		panic(err)
 	}
-	return r
+	r := new(big.Int).SetBytes(buf)
+	return r.Rsh(r, uint(len(buf)*8)-s.ABSize)
 }
 
 func (s *SRP) is_AB_valid(AB *big.Int) bool {
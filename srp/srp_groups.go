@@ -24,8 +24,16 @@ package srp
 import (
 	"fmt"
 	"math/big"
+	"sync"
 )
 
+// MinGroupSize is the smallest prime, in bits, that RegisterGroup accepts.
+const MinGroupSize = 1024
+
+// primeRounds is how many Miller-Rabin rounds are used on top of the
+// Baillie-PSW test when checking primes.
+const primeRounds = 8
+
 type SRPGroup struct {
 	Size      int      // Size in bits
 	Prime     *big.Int // N
@@ -583,19 +591,71 @@ var srp_groups map[string]*SRPGroup = map[string]*SRPGroup{
 	"rfc5054.8192": rfc5054_group8192,
 }
 
+var srp_groups_mutex sync.RWMutex
+
 // GetGroup retrieves a registered SRPGroup (the prime N and the generator g)
 // The pre-registered groups are: 1024, 1536, 2048, 3072, 4096, 6144, and 8192
-// This function must be called by only one goroutine at a time.
 func GetGroup(group string) (*SRPGroup, error) {
+	srp_groups_mutex.RLock()
 	grp, ok := srp_groups[group]
+	srp_groups_mutex.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("Invalid SRP Prime: %s", group)
 	}
 	return grp, nil
 }
 
-// RegisterGroup will register a SRPGroup for use with SRP.
-// This function must be called by only one goroutine at a time.
-func RegisterGroup(name string, group *SRPGroup) {
+// RegisterGroup will register a SRPGroup for use with SRP after checking it
+// with Validate.  A name can't be reused for a different group, but
+// registering the same group again is harmless.
+func RegisterGroup(name string, group *SRPGroup) error {
+	srp_groups_mutex.Lock()
+	defer srp_groups_mutex.Unlock()
+
+	if existing, ok := srp_groups[name]; ok {
+		if existing.Prime.Cmp(group.Prime) == 0 && existing.Generator.Cmp(group.Generator) == 0 {
+			return nil
+		}
+		return fmt.Errorf("SRP group %s is already registered", name)
+	}
+
+	err := group.Validate(MinGroupSize)
+	if err != nil {
+		return fmt.Errorf("SRP group %s: %s", name, err.Error())
+	}
+
 	srp_groups[name] = group
+	return nil
+}
+
+// Validate checks that N is a safe prime of at least minSize bits and that g
+// generates a large subgroup.  A safe prime N = 2q + 1 only has subgroups of
+// order 1, 2, q and 2q, so any g between 1 and N - 1 generates one of order q
+// or 2q.
+func (group *SRPGroup) Validate(minSize int) error {
+	N, g := group.Prime, group.Generator
+	if N == nil || g == nil {
+		return fmt.Errorf("N and g are required")
+	}
+	if group.Size != N.BitLen() {
+		return fmt.Errorf("N is %d bits instead of %d", N.BitLen(), group.Size)
+	}
+	if group.Size < minSize {
+		return fmt.Errorf("N is %d bits, the minimum is %d", group.Size, minSize)
+	}
+
+	if !N.ProbablyPrime(primeRounds) {
+		return fmt.Errorf("N is not prime")
+	}
+	q := new(big.Int).Rsh(N, 1)
+	if !q.ProbablyPrime(primeRounds) {
+		return fmt.Errorf("N is not a safe prime")
+	}
+
+	one := big.NewInt(1)
+	Nminus1 := new(big.Int).Sub(N, one)
+	if g.Cmp(one) <= 0 || g.Cmp(Nminus1) >= 0 {
+		return fmt.Errorf("g must be between 1 and N - 1")
+	}
+	return nil
 }
@@ -0,0 +1,105 @@
+// Copyright 2016 Alex Mayfield <alexmax2742@gmail.com>
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package srp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestValidateGroup(t *testing.T) {
+	for _, g := range groups {
+		grp, err := GetGroup(g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if grp.Size > 4096 && testing.Short() {
+			continue
+		}
+		err = grp.Validate(MinGroupSize)
+		// The openssl groups were not extracted correctly and none of
+		// them are safe primes.
+		if strings.HasPrefix(g, "openssl.") {
+			if err == nil {
+				t.Errorf("%s is unexpectedly valid", g)
+			}
+		} else if err != nil {
+			t.Errorf("%s is not valid (%v)", g, err)
+		}
+	}
+
+	N := rfc5054_group2048.Prime
+	notPrime := new(big.Int).Add(N, big.NewInt(2))
+	notSafe, err := rand.Prime(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]*SRPGroup{
+		"no prime":     {Size: 2048, Generator: big.NewInt(2)},
+		"wrong size":   {Size: 3072, Prime: N, Generator: big.NewInt(2)},
+		"too small":    {Size: 1024, Prime: rfc5054_group1024.Prime, Generator: big.NewInt(2)},
+		"not prime":    {Size: notPrime.BitLen(), Prime: notPrime, Generator: big.NewInt(2)},
+		"not safe":     {Size: 2048, Prime: notSafe, Generator: big.NewInt(2)},
+		"g is 0":       {Size: 2048, Prime: N, Generator: big.NewInt(0)},
+		"g is 1":       {Size: 2048, Prime: N, Generator: big.NewInt(1)},
+		"g is N - 1":   {Size: 2048, Prime: N, Generator: new(big.Int).Sub(N, big.NewInt(1))},
+		"g is N":       {Size: 2048, Prime: N, Generator: new(big.Int).Set(N)},
+		"g is too big": {Size: 2048, Prime: N, Generator: new(big.Int).Add(N, big.NewInt(2))},
+	}
+	for name, grp := range tests {
+		if grp.Validate(2048) == nil {
+			t.Errorf("Group with %s was accepted", name)
+		}
+	}
+
+	// Generators of the subgroups of order 2q and q are both acceptable.
+	for _, g := range []int64{2, 4} {
+		grp := &SRPGroup{Size: 2048, Prime: N, Generator: big.NewInt(g)}
+		err = grp.Validate(2048)
+		if err != nil {
+			t.Errorf("Group with g of %d was rejected (%v)", g, err)
+		}
+	}
+}
+
+func TestRegisterGroup(t *testing.T) {
+	grp := &SRPGroup{Size: 2048, Prime: rfc5054_group2048.Prime, Generator: big.NewInt(5)}
+	err := RegisterGroup("test.2048", grp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RegisterGroup("test.2048", &SRPGroup{Size: 2048, Prime: rfc5054_group2048.Prime, Generator: big.NewInt(5)})
+	if err != nil {
+		t.Errorf("Registering the same group again failed (%v)", err)
+	}
+	err = RegisterGroup("test.2048", rfc5054_group2048)
+	if err == nil {
+		t.Errorf("A registered group was replaced")
+	}
+	err = RegisterGroup("test.bad", &SRPGroup{Size: 2048, Prime: rfc5054_group2048.Prime, Generator: big.NewInt(1)})
+	if err == nil {
+		t.Errorf("An invalid group was registered")
+	}
+	_, err = GetGroup("test.bad")
+	if err == nil {
+		t.Errorf("An invalid group can be retrieved")
+	}
+
+	testSRP(t, "test.2048", sha256.New, []byte("test"), []byte("password"))
+}
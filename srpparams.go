@@ -0,0 +1,252 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-ini/ini"
+
+	"github.com/AlexMax/charon/srp"
+)
+
+// SRP group, hash and key derivation that version 2 of the protocol always
+// uses.  Users whose verifiers use anything else need a version 3 game server.
+const (
+	LegacySRPGroup = "rfc5054.2048"
+	LegacySRPHash  = "sha256"
+	LegacyKDF      = "rfc2945"
+)
+
+// Upper bounds on key derivation parameters, so a game server can't be told
+// to exhaust its memory or CPU.
+const (
+	maxScryptN       = 1 << 20
+	maxScryptR       = 32
+	maxScryptP       = 16
+	maxArgon2Time    = 16
+	maxArgon2Memory  = 1 << 21
+	maxArgon2Threads = 64
+)
+
+// kdfLimits are the parameters each parameterized key derivation takes, and
+// their upper bounds.
+var kdfLimits = map[string]map[string]uint64{
+	"scrypt":   {"N": maxScryptN, "r": maxScryptR, "p": maxScryptP},
+	"argon2id": {"t": maxArgon2Time, "m": maxArgon2Memory, "p": maxArgon2Threads},
+}
+
+// SRPHashes are the hash functions that verifiers may use, by name.
+var SRPHashes = map[string]srp.HashFunc{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// NewSRP creates an SRP context from the names of a group and hash and a key
+// derivation spec.
+func NewSRP(group string, hash string, kdf string) (*srp.SRP, error) {
+	hashFunc, ok := SRPHashes[hash]
+	if !ok {
+		return nil, fmt.Errorf("Invalid Hash: %s", hash)
+	}
+	kd, err := NewKDF(kdf)
+	if err != nil {
+		return nil, err
+	}
+	return srp.NewSRP(group, hashFunc, kd)
+}
+
+// NewKDF parses a key derivation spec, which is either "rfc2945",
+// "scrypt:N=<cost>,r=<block size>,p=<parallelism>" or
+// "argon2id:t=<passes>,m=<KiB>,p=<threads>".  The RFC 2945 derivation is
+// returned as nil, which the srp package uses by default.
+func NewKDF(spec string) (kd srp.KeyDerivationFunc, err error) {
+	name, params, _ := strings.Cut(spec, ":")
+	switch name {
+	case LegacyKDF:
+		if params != "" {
+			return nil, fmt.Errorf("Invalid KDF: %s takes no parameters", name)
+		}
+		return nil, nil
+	case "scrypt":
+		values, err := parseKDFParams(params, kdfLimits[name])
+		if err != nil {
+			return nil, err
+		}
+		return srp.ScryptKDF(int(values["N"]), int(values["r"]), int(values["p"]))
+	case "argon2id":
+		values, err := parseKDFParams(params, kdfLimits[name])
+		if err != nil {
+			return nil, err
+		}
+		return srp.Argon2idKDF(uint32(values["t"]), uint32(values["m"]), uint8(values["p"]))
+	default:
+		return nil, fmt.Errorf("Invalid KDF: %s", spec)
+	}
+}
+
+// strongerKDF returns true if the key derivation spec kdf is stronger than
+// than.  Anything beats rfc2945, but nothing beats a key derivation of
+// another kind, and the same kind only wins if none of its parameters are
+// lower.
+func strongerKDF(kdf string, than string) bool {
+	name, params, _ := strings.Cut(kdf, ":")
+	thanName, thanParams, _ := strings.Cut(than, ":")
+	if name == LegacyKDF {
+		return false
+	} else if thanName == LegacyKDF {
+		return true
+	} else if name != thanName {
+		return false
+	}
+
+	values, err := parseKDFParams(params, kdfLimits[name])
+	if err != nil {
+		return false
+	}
+	thanValues, err := parseKDFParams(thanParams, kdfLimits[name])
+	if err != nil {
+		return false
+	}
+
+	stronger := false
+	for key, value := range values {
+		if value < thanValues[key] {
+			return false
+		} else if value > thanValues[key] {
+			stronger = true
+		}
+	}
+	return stronger
+}
+
+// parseKDFParams parses comma-separated key=value parameters.  Every key in
+// limits must be present exactly once and not exceed its limit.
+func parseKDFParams(params string, limits map[string]uint64) (values map[string]uint64, err error) {
+	values = make(map[string]uint64)
+	if params == "" {
+		return nil, errors.New("Invalid KDF: missing parameters")
+	}
+	for _, param := range strings.Split(params, ",") {
+		key, value, ok := strings.Cut(param, "=")
+		limit, known := limits[key]
+		if !ok || !known {
+			return nil, fmt.Errorf("Invalid KDF parameter: %s", param)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("Duplicate KDF parameter: %s", key)
+		}
+		values[key], err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid KDF parameter: %s", param)
+		}
+		if values[key] > limit {
+			return nil, fmt.Errorf("KDF parameter %s is larger than %d", key, limit)
+		}
+	}
+	if len(values) != len(limits) {
+		return nil, errors.New("Invalid KDF: missing parameters")
+	}
+	return
+}
+
+// LoadSRPGroups registers the custom groups in an ini file.  Every section
+// is a group, named after the section, with a hexadecimal "prime" and a
+// decimal "generator".  Groups are validated before they are registered.
+func LoadSRPGroups(filename string) (err error) {
+	file, err := ini.Load(filename)
+	if err != nil {
+		return
+	}
+
+	for _, section := range file.Sections() {
+		if section.Name() == ini.DEFAULT_SECTION {
+			continue
+		}
+
+		prime, ok := new(big.Int).SetString(strings.Join(strings.Fields(section.Key("prime").String()), ""), 16)
+		if !ok {
+			return fmt.Errorf("SRP group %s: prime is not hexadecimal", section.Name())
+		}
+		generator, ok := new(big.Int).SetString(section.Key("generator").String(), 10)
+		if !ok {
+			return fmt.Errorf("SRP group %s: generator is not a number", section.Name())
+		}
+
+		err = srp.RegisterGroup(section.Name(), &srp.SRPGroup{
+			Size:      prime.BitLen(),
+			Prime:     prime,
+			Generator: generator,
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// trustedGroup is a group and the minimum size it was checked against.
+type trustedGroup struct {
+	name    string
+	minSize int
+}
+
+// trustedGroups caches the result of checking a group, since proving that a
+// large prime is safe takes a while.
+var trustedGroups sync.Map
+
+// checkSRPGroup returns an error if a group is unknown, smaller than minSize
+// or not a safe group to use.
+func checkSRPGroup(name string, minSize int) error {
+	key := trustedGroup{name, minSize}
+	if result, ok := trustedGroups.Load(key); ok {
+		err, _ := result.(error)
+		return err
+	}
+
+	// Unknown groups aren't cached, since they might be loaded later.
+	group, err := srp.GetGroup(name)
+	if err != nil {
+		return err
+	}
+
+	err = group.Validate(minSize)
+	if err != nil {
+		err = fmt.Errorf("SRP group %s is not trusted: %s", name, err.Error())
+		log.Printf("[WARNING] %s", err.Error())
+	}
+	trustedGroups.Store(key, err)
+	return err
+}
+
+// isLegacySRP returns true if a group, hash and key derivation can be used
+// with version 2 of the protocol.
+func isLegacySRP(group string, hash string, kdf string) bool {
+	return group == LegacySRPGroup && hash == LegacySRPHash && kdf == LegacyKDF
+}
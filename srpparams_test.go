@@ -0,0 +1,165 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AlexMax/charon/srp"
+)
+
+func TestNewKDF(t *testing.T) {
+	tests := []struct {
+		spec  string
+		valid bool
+	}{
+		{"rfc2945", true},
+		{"scrypt:N=16384,r=8,p=1", true},
+		{"scrypt:p=1,r=8,N=16384", true},
+		{"argon2id:t=3,m=65536,p=4", true},
+		{"", false},
+		{"rfc2945:N=1", false},
+		{"bcrypt:cost=10", false},
+		{"scrypt", false},
+		{"scrypt:N=16384,r=8", false},
+		{"scrypt:N=16384,r=8,p=1,p=1", false},
+		{"scrypt:N=16384,r=8,p=1,x=1", false},
+		{"scrypt:N=16000,r=8,p=1", false},
+		{"scrypt:N=-1,r=8,p=1", false},
+		{"scrypt:N=2097152,r=8,p=1", false},
+		{"argon2id:t=3,m=8388608,p=4", false},
+		{"argon2id:t=0,m=65536,p=4", false},
+	}
+
+	for _, test := range tests {
+		kd, err := NewKDF(test.spec)
+		if test.valid && err != nil {
+			t.Errorf("%s was rejected (%v)", test.spec, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s was accepted", test.spec)
+		}
+		if test.valid && test.spec != LegacyKDF && kd == nil {
+			t.Errorf("%s has no key derivation function", test.spec)
+		}
+	}
+}
+
+func TestStrongerKDF(t *testing.T) {
+	tests := []struct {
+		kdf      string
+		than     string
+		stronger bool
+	}{
+		{"scrypt:N=16384,r=8,p=1", "rfc2945", true},
+		{"argon2id:t=3,m=65536,p=4", "rfc2945", true},
+		{"rfc2945", "rfc2945", false},
+		{"rfc2945", "argon2id:t=3,m=65536,p=4", false},
+		{"argon2id:t=3,m=65536,p=4", "argon2id:t=3,m=65536,p=4", false},
+		{"argon2id:t=3,m=131072,p=4", "argon2id:t=3,m=65536,p=4", true},
+		{"argon2id:t=4,m=32768,p=4", "argon2id:t=3,m=65536,p=4", false},
+		{"scrypt:p=1,r=8,N=32768", "scrypt:N=16384,r=8,p=1", true},
+		{"argon2id:t=3,m=65536,p=4", "scrypt:N=16384,r=8,p=1", false},
+	}
+
+	for _, test := range tests {
+		if strongerKDF(test.kdf, test.than) != test.stronger {
+			t.Errorf("%s stronger than %s is not %v", test.kdf, test.than, test.stronger)
+		}
+	}
+}
+
+func writeGroups(t *testing.T, contents string) string {
+	filename := filepath.Join(t.TempDir(), "groups.ini")
+	err := os.WriteFile(filename, []byte(contents), 0600)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	return filename
+}
+
+func TestLoadSRPGroups(t *testing.T) {
+	rfc2048, _ := srp.GetGroup("rfc5054.2048")
+	prime := rfc2048.Prime.Text(16)
+
+	// Whitespace in the prime is ignored.
+	spaced := prime[:64] + " " + prime[64:]
+	err := LoadSRPGroups(writeGroups(t, "[custom.2048]\nprime = "+spaced+"\ngenerator = 5\n"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	group, err := srp.GetGroup("custom.2048")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	if group.Size != 2048 || group.Generator.Int64() != 5 {
+		t.Errorf("Group is %d bits with generator %v", group.Size, group.Generator)
+	}
+	err = checkSRPGroup("custom.2048", 2048)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	err = checkSRPGroup("custom.2048", 3072)
+	if err == nil {
+		t.Errorf("Group smaller than the minimum size is trusted")
+	}
+
+	tests := map[string]string{
+		"bad prime":       "[bad.prime]\nprime = xyz\ngenerator = 2\n",
+		"bad generator":   "[bad.generator]\nprime = " + prime + "\ngenerator = two\n",
+		"unsafe group":    "[bad.unsafe]\nprime = " + prime + "\ngenerator = 1\n",
+		"duplicate group": "[rfc5054.2048]\nprime = " + prime + "\ngenerator = 5\n",
+	}
+	for name, contents := range tests {
+		err = LoadSRPGroups(writeGroups(t, contents))
+		if err == nil {
+			t.Errorf("Groups file with %s was loaded", name)
+		}
+	}
+	_, err = srp.GetGroup("bad.unsafe")
+	if err == nil {
+		t.Errorf("Unsafe group was registered")
+	}
+
+	err = LoadSRPGroups(filepath.Join(t.TempDir(), "missing.ini"))
+	if err == nil {
+		t.Errorf("Missing groups file was loaded")
+	}
+}
+
+func TestCheckSRPGroup(t *testing.T) {
+	err := checkSRPGroup("rfc5054.2048", 2048)
+	if err != nil {
+		t.Errorf("%s", err.Error())
+	}
+	err = checkSRPGroup("rfc5054.1024", 2048)
+	if err == nil || !strings.Contains(err.Error(), "minimum") {
+		t.Errorf("Group smaller than the minimum size returned %v", err)
+	}
+	err = checkSRPGroup("openssl.2048", 2048)
+	if err == nil {
+		t.Errorf("Invalid builtin group is trusted")
+	}
+	err = checkSRPGroup("nonexistent", 2048)
+	if err == nil {
+		t.Errorf("Unknown group is trusted")
+	}
+}
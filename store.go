@@ -0,0 +1,90 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"context"
+	"time"
+)
+
+// Store is everything the auth server, web server and cmanage need from a
+// database.  Database implements it for every supported driver.  Methods are
+// safe to call concurrently.
+type Store interface {
+	// AddUser adds a new user.
+	AddUser(ctx context.Context, username string, email string, password string) error
+	// UpdateUser saves changes to an existing user's email, access level
+	// and active flag.
+	UpdateUser(ctx context.Context, user *User) error
+	// FindUser tries to find a specific user by name or email address.
+	FindUser(ctx context.Context, username string) (*User, error)
+	// FindUserByName tries to find a specific user by name only.
+	FindUserByName(ctx context.Context, username string) (*User, error)
+	// LoginUser tries to log a user in with the passed username and
+	// password.
+	LoginUser(ctx context.Context, username string, password string) (*User, error)
+
+	// FindProfile tries to find the profile belonging to a specific user.
+	FindProfile(ctx context.Context, userID uint) (*Profile, error)
+	// AddProfile adds a profile for a user that doesn't have one.
+	AddProfile(ctx context.Context, profile *Profile) error
+	// UpdateProfile saves changes to a user's profile.
+	UpdateProfile(ctx context.Context, profile *Profile) error
+	// ListProfiles returns up to limit profiles, skipping the first offset.
+	ListProfiles(ctx context.Context, offset int, limit int) ([]Profile, error)
+
+	// AddServer registers a new game server.
+	AddServer(ctx context.Context, name string, networks []string) (*Server, error)
+	// FindServer tries to find a specific game server by ID.
+	FindServer(ctx context.Context, id uint) (*Server, error)
+	// RotateServerSecret replaces the secret of an active game server.
+	RotateServerSecret(ctx context.Context, id uint) ([]byte, error)
+	// RevokeServer stops a game server from making any further requests.
+	RevokeServer(ctx context.Context, id uint) error
+
+	// AddSession stores a new session.
+	AddSession(ctx context.Context, record *SessionRecord, now time.Time, max int) error
+	// FindSession tries to find a session that hasn't expired.
+	FindSession(ctx context.Context, id uint32, now time.Time) (*SessionRecord, error)
+	// UpdateSession saves the handshake state of a session that is still
+	// in the passed state.
+	UpdateSession(ctx context.Context, record *SessionRecord, prevState SessionState, now time.Time) error
+	// DeleteSession removes a session, if it exists.
+	DeleteSession(ctx context.Context, id uint32) error
+	// DeleteExpiredSessions removes every session that has expired.
+	DeleteExpiredSessions(ctx context.Context, now time.Time) error
+	// PendingSessions counts the sessions that have neither expired nor
+	// been completed.
+	PendingSessions(ctx context.Context, now time.Time) (int, error)
+
+	// Migrate applies or reverts migrations until the schema is at the
+	// target version.
+	Migrate(ctx context.Context, target int) error
+	// SchemaVersion returns the version of the newest migration applied.
+	SchemaVersion(ctx context.Context) (int, error)
+	// MigrationStatus lists every migration and when it was applied.
+	MigrationStatus(ctx context.Context) ([]Migration, error)
+
+	// Import executes files containing SQL statements.
+	Import(ctx context.Context, paths ...string) error
+	// Close closes the database connection.
+	Close() error
+}
+
+var _ Store = (*Database)(nil)
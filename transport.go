@@ -0,0 +1,172 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transport sends a response back the way its request arrived.
+type transport interface {
+	respond(res response) error
+}
+
+// udpTransport responds with a single packet.
+type udpTransport struct {
+	conn *net.UDPConn
+}
+
+func (transport udpTransport) respond(res response) (err error) {
+	_, err = transport.conn.WriteTo(res.message, res.address)
+	return
+}
+
+// tcpTransport responds with a length-prefixed message on the connection
+// that the request arrived on.
+type tcpTransport struct {
+	conn    net.Conn
+	timeout time.Duration // How long a response may take to write
+	mutex   sync.Mutex    // Workers may respond on the same connection at once
+}
+
+func (transport *tcpTransport) respond(res response) (err error) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+
+	// Don't let a client that stops reading tie up a worker.
+	if transport.timeout > 0 {
+		err = transport.conn.SetWriteDeadline(time.Now().Add(transport.timeout))
+		if err != nil {
+			return
+		}
+	}
+
+	err = WriteStreamMessage(transport.conn, res.message)
+	if err != nil {
+		// A partly written message can't be followed by another.
+		transport.conn.Close()
+	}
+	return
+}
+
+// tcpClients tracks open TCP connections so they can be limited and closed
+// on shutdown.
+type tcpClients struct {
+	conns   map[net.Conn]struct{}
+	max     int // A max of 0 places no limit on connections
+	mutex   sync.Mutex
+	readers sync.WaitGroup
+}
+
+func newTCPClients(max int) *tcpClients {
+	return &tcpClients{conns: make(map[net.Conn]struct{}), max: max}
+}
+
+// add tracks a connection, or returns false if too many are open.
+func (clients *tcpClients) add(conn net.Conn) bool {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+	if clients.max > 0 && len(clients.conns) >= clients.max {
+		return false
+	}
+	clients.conns[conn] = struct{}{}
+	clients.readers.Add(1)
+	return true
+}
+
+func (clients *tcpClients) remove(conn net.Conn) {
+	clients.mutex.Lock()
+	delete(clients.conns, conn)
+	clients.mutex.Unlock()
+	clients.readers.Done()
+}
+
+// closeAll closes every connection and waits for their readers to return.
+func (clients *tcpClients) closeAll() {
+	clients.mutex.Lock()
+	for conn := range clients.conns {
+		conn.Close()
+	}
+	clients.mutex.Unlock()
+	clients.readers.Wait()
+}
+
+// acceptTCP accepts TCP connections and reads requests from them until the
+// listener is closed.
+func (authApp *AuthApp) acceptTCP(listener net.Listener, queue chan<- queuedRequest, clients *tcpClients) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("[ERROR] %s", err.Error())
+
+			// Don't spin if we're out of file descriptors or similar.
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		if !clients.add(conn) {
+			log.Printf("[WARNING] Too many TCP connections, closing connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer clients.remove(conn)
+			authApp.readTCPRequests(conn, queue)
+		}()
+	}
+}
+
+// readTCPRequests reads requests from a TCP connection and queues them for
+// the workers until the connection is closed or goes idle.  Like UDP,
+// requests are dropped when the queue is full, and game servers are expected
+// to retransmit them.
+func (authApp *AuthApp) readTCPRequests(conn net.Conn, queue chan<- queuedRequest) {
+	defer conn.Close()
+
+	transport := &tcpTransport{conn: conn, timeout: authApp.config.Auth.TCPTimeout}
+	for {
+		if authApp.config.Auth.TCPTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(authApp.config.Auth.TCPTimeout))
+		}
+
+		message, err := ReadStreamMessage(conn)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("[DEBUG] %s", err.Error())
+			}
+			return
+		}
+		atomic.AddUint64(&authApp.stats.Received, 1)
+
+		select {
+		case queue <- queuedRequest{transport, request{conn.RemoteAddr(), message}, nil}:
+		default:
+			atomic.AddUint64(&authApp.stats.Dropped, 1)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2014-2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// A client that stops reading can't hold up a worker forever.
+func TestTCPTransportWriteTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	transport := &tcpTransport{conn: server, timeout: 10 * time.Millisecond}
+	done := make(chan error, 1)
+	go func() {
+		done <- transport.respond(response{message: []byte("response")})
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Response was written to a client that isn't reading")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Response did not time out")
+	}
+}
+
+// Requests are dropped instead of waiting for room in a full queue.
+func TestReadTCPRequestsQueueFull(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+
+	server, client := net.Pipe()
+	queue := make(chan queuedRequest)
+	done := make(chan struct{})
+	go func() {
+		app.readTCPRequests(server, queue)
+		close(done)
+	}()
+
+	err := WriteStreamMessage(client, []byte("request"))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reader is blocked on a full queue")
+	}
+	if stats := app.Stats(); stats.Received != 1 || stats.Dropped != 1 {
+		t.Errorf("Received %d and dropped %d requests", stats.Received, stats.Dropped)
+	}
+}
+
+// Connections past the limit are closed straight away.
+func TestServeTCPMaxConns(t *testing.T) {
+	app, _ := newTestAuthApp(t, nil, UserAccessUser)
+	app.config.Auth.MaxTCPConns = 1
+	app.config.Auth.ShutdownTimeout = 100 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- app.ServeWithTCP(ctx, nil, []net.Listener{listener})
+	}()
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer first.Close()
+	err = exchangeHandshake(func(req []byte) ([]byte, error) {
+		return tcpExchange(first, req)
+	}, 1, "username", "password")
+	if err != nil {
+		t.Errorf("Handshake over TCP failed (%v)", err)
+	}
+
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("Connection past the limit returned %v instead of %v", err, io.EOF)
+	}
+
+	cancel()
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Errorf("Serve returned an error (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after shutdown")
+	}
+}
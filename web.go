@@ -19,9 +19,13 @@
 package charon
 
 import (
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"html/template"
+	"log"
+	"net"
 	"net/http"
 
 	gcontext "github.com/gorilla/context"
@@ -48,24 +52,21 @@ const sessionName = "session"
 // WebApp contains all state for a single instance of the webserver.
 type WebApp struct {
 	config       *Config
-	database     *Database
+	database     Store
 	mux          *goji.Mux
 	sessionStore gsessions.Store
 	templates    templateStore
 }
 
-// NewWebApp creates a new instance of the web server app.
-func NewWebApp(config *Config) (webApp *WebApp, err error) {
+// NewWebApp creates a new instance of the web server app.  The database may
+// be shared with other apps, and is not closed by the web server.
+func NewWebApp(config *Config, database Store) (webApp *WebApp, err error) {
 	webApp = new(WebApp)
 
 	// Attach configuration
 	webApp.config = config
 
-	// Initialize database connection
-	database, err := NewDatabase(config)
-	if err != nil {
-		return
-	}
+	// Attach database
 	webApp.database = database
 
 	// Initialize mux
@@ -93,10 +94,59 @@ func NewWebApp(config *Config) (webApp *WebApp, err error) {
 	return
 }
 
-// ListenAndServe has the web server listen on a specific address and port,
-// essentially passing straight through to the http method of the same name.
-func (webApp *WebApp) ListenAndServe(addr string) (err error) {
-	return http.ListenAndServe(addr, webApp.mux)
+// ListenAndServe has the web server listen on one or more addresses.  See
+// Serve for how the server is stopped.
+func (webApp *WebApp) ListenAndServe(ctx context.Context, addrs ...string) (err error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+		log.Printf("[DEBUG] Web server listening on %s", listener.Addr())
+	}
+
+	return webApp.Serve(ctx, listeners...)
+}
+
+// Serve has the web server accept connections on one or more existing
+// listeners.  Once the context is cancelled, the listeners are closed and
+// requests that are in progress are given until the configured shutdown
+// timeout to finish before Serve returns.  If a listener fails, the others
+// are closed and its error is returned.
+func (webApp *WebApp) Serve(ctx context.Context, listeners ...net.Listener) (err error) {
+	if len(listeners) == 0 {
+		return errors.New("no listeners to serve")
+	}
+
+	server := &http.Server{Handler: webApp.mux}
+
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(listener)
+	}
+
+	select {
+	case err = <-errs:
+		server.Close()
+		return
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), webApp.config.Web.ShutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("[WARNING] %s", err.Error())
+	}
+
+	return nil
 }
 
 // AddTemplateDefs takes the passed template definitions, figures out where they
@@ -0,0 +1,150 @@
+/*
+ *  Charon: A game authentication server
+ *  Copyright (C) 2016  Alex Mayfield <alexmax2742@gmail.com>
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published by
+ *  the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package charon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebAppShutdown(t *testing.T) {
+	config := NewConfig(nil)
+	app, err := NewWebApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- app.ListenAndServe(ctx, "127.0.0.1:0")
+	}()
+
+	cancel()
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Errorf("ListenAndServe returned an error (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServe did not return after shutdown")
+	}
+}
+
+func TestWebAppDualStack(t *testing.T) {
+	config := NewConfig(nil)
+	app, err := NewWebApp(config, newTestDatabase(t, config))
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	listener4, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	listener6, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		listener4.Close()
+		t.Skipf("IPv6 loopback is not available (%v)", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- app.Serve(ctx, listener4, listener6)
+	}()
+
+	for _, listener := range []net.Listener{listener4, listener6} {
+		res, err := http.Get(fmt.Sprintf("http://%s/", listener.Addr()))
+		if err != nil {
+			t.Errorf("Request to %s failed (%v)", listener.Addr(), err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("Request to %s returned %s", listener.Addr(), res.Status)
+		}
+	}
+
+	cancel()
+	select {
+	case err = <-errs:
+		if err != nil {
+			t.Errorf("Serve returned an error (%v)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after shutdown")
+	}
+}
+
+// The auth server and website see the same users when they share a
+// database, even an in-memory one.
+func TestSharedDatabase(t *testing.T) {
+	config := NewConfig(nil)
+	database := newTestDatabase(t, config)
+
+	err := database.AddUser(context.Background(), "username", "charontest@mailinator.com", "password")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	user, err := database.FindUser(context.Background(), "username")
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	user.Access = UserAccessUser
+	user.Active = true
+	err = database.UpdateUser(context.Background(), user)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	authApp, err := NewAuthApp(config, database)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+	webApp, err := NewWebApp(config, database)
+	if err != nil {
+		t.Fatalf("%s", err.Error())
+	}
+
+	var authProof AuthProof
+	err = authProof.UnmarshalBinary(handshake(t, authApp, 3, "username", "password"))
+	if err != nil {
+		t.Fatalf("AuthProof did not unmarshall correctly (%v)", err)
+	}
+	if authProof.Username != "username" {
+		t.Errorf("Username is %v instead of username", authProof.Username)
+	}
+
+	form := url.Values{"login": {"charontest@mailinator.com"}, "password": {"password"}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	webApp.mux.ServeHTTP(res, req)
+	if res.Code != http.StatusFound {
+		t.Errorf("Login returned %d instead of %d", res.Code, http.StatusFound)
+	}
+}
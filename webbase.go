@@ -58,7 +58,7 @@ func (webApp *WebApp) Login(ctx context.Context, res http.ResponseWriter, req *h
 			Password: req.PostFormValue("password"),
 		}
 		var user *User
-		user, data.Errors = data.Form.Validate(webApp.database)
+		user, data.Errors = data.Form.Validate(ctx, webApp.database)
 		if len(data.Errors) > 0 {
 			webApp.RenderTemplate(res, req, "login", data)
 			return
@@ -90,7 +90,7 @@ func (webApp *WebApp) Login(ctx context.Context, res http.ResponseWriter, req *h
 }
 
 // Validate validates the LoginForm.
-func (form *LoginForm) Validate(db *Database) (user *User, formErrors FormErrors) {
+func (form *LoginForm) Validate(ctx context.Context, db Store) (user *User, formErrors FormErrors) {
 	formErrors = make(FormErrors)
 	if len(form.Login) == 0 {
 		formErrors["Login"] = "A username or e-mail address is required."
@@ -105,7 +105,7 @@ func (form *LoginForm) Validate(db *Database) (user *User, formErrors FormErrors
 	}
 
 	// Try and log the user in.
-	user, err := db.LoginUser(form.Login, form.Password)
+	user, err := db.LoginUser(ctx, form.Login, form.Password)
 	if err != nil {
 		formErrors["Flash"] = "Invalid username or password"
 	}